@@ -0,0 +1,136 @@
+// Admin.go serves an HTTP API for looking after the server while it runs.
+// Every request needs an "Authorization: Bearer <token>" header with the admin token, which is read from a file
+// or the environment (see LoadAdminToken.)
+//   GET    /files                 Lists the files, with their size, when they were created and who uploaded them.
+//   GET    /files?dir=<dir>       Lists the files and subdirectories in a directory.
+//   PUT    /files/<name>          Uploads a file, without applying remapping rules.
+//   DELETE /files/<name>          Deletes a file.
+//   POST   /files/<name>?to=<new> Renames a file.
+//   GET    /transfers             Lists the transfers in progress.
+//   DELETE /transfers/<id>        Aborts a transfer.
+//   GET    /stats                 Shows how well identical pages are being deduplicated.
+// Replies are JSON, except for errors, which are plain text.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Admin struct {
+	Fs        *FileSystem
+	Transfers *Transfers
+	Token     string
+}
+
+func MakeAdmin(fs *FileSystem, transfers *Transfers, token string) *Admin {
+	return &Admin{Fs: fs, Transfers: transfers, Token: token}
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.Authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/files" && r.Method == "GET" && r.URL.Query().Has("dir"):
+		a.ServeDir(w, r.URL.Query().Get("dir"))
+	case r.URL.Path == "/files" && r.Method == "GET":
+		WriteJSON(w, a.Fs.List())
+	case r.URL.Path == "/transfers" && r.Method == "GET":
+		WriteJSON(w, a.Transfers.List())
+	case r.URL.Path == "/stats" && r.Method == "GET":
+		WriteJSON(w, a.Fs.PageStore.Stats())
+	case strings.HasPrefix(r.URL.Path, "/files/"):
+		a.ServeFile(w, r, strings.TrimPrefix(r.URL.Path, "/files/"))
+	case strings.HasPrefix(r.URL.Path, "/transfers/") && r.Method == "DELETE":
+		a.Abort(w, strings.TrimPrefix(r.URL.Path, "/transfers/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// The environment variable the admin token is read from when there's no token file.
+// The token isn't taken as a flag, since anybody on the host can see a process's arguments.
+const AdminTokenVariable = "TFTPD_ADMIN_TOKEN"
+
+// Reads the admin token from the file, or from the environment if there's no file.
+// Surrounding whitespace, like a trailing newline, isn't part of the token.
+func LoadAdminToken(path string) (string, error) {
+	if path == "" {
+		return strings.TrimSpace(os.Getenv(AdminTokenVariable)), nil
+	}
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// An empty token never matches, so the API can't be left open by accident.
+func (a *Admin) Authorized(r *http.Request) bool {
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return hasToken && a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *Admin) ServeFile(w http.ResponseWriter, r *http.Request, filename string) {
+	var err *ErrorPacket
+
+	switch r.Method {
+	case "PUT":
+		ws := MakeWriteSession(a.Fs)
+		ws.RemoteAddr = ParseRemoteAddr(r.RemoteAddr)
+		err = Upload(ws, filename, r.Body, r.ContentLength)
+		if err == nil {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	case "DELETE":
+		err = a.Fs.Delete(filename)
+	case "POST":
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			http.Error(w, "Missing new filename", http.StatusBadRequest)
+			return
+		}
+		err = a.Fs.Rename(filename, to)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		WriteHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) ServeDir(w http.ResponseWriter, dir string) {
+	entries, exists := a.Fs.ReadDir(dir)
+	if !exists {
+		http.Error(w, "No such directory", http.StatusNotFound)
+		return
+	}
+	WriteJSON(w, entries)
+}
+
+func (a *Admin) Abort(w http.ResponseWriter, id string) {
+	transferId, err := strconv.Atoi(id)
+	if err != nil || !a.Transfers.Abort(transferId) {
+		http.Error(w, "No such transfer", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func WriteJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
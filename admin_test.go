@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var AdminHeader = http.Header{"Authorization": {"Bearer letmein"}}
+
+func TestAdminAuthorization(t *testing.T) {
+	server := httptest.NewServer(MakeAdmin(MakeFileSystem(), MakeTransfers(), "letmein"))
+	defer server.Close()
+
+	response, _ := Request(t, "GET", server.URL+"/files", nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusUnauthorized, "Requests without a token should be refused")
+
+	response, _ = Request(t, "GET", server.URL+"/files", nil, http.Header{"Authorization": {"Bearer wrong"}})
+	ErrorIf(t, response.StatusCode != http.StatusUnauthorized, "Requests with the wrong token should be refused")
+
+	response, _ = Request(t, "GET", server.URL+"/files", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusOK, "Requests with the token should be allowed")
+
+	server = httptest.NewServer(MakeAdmin(MakeFileSystem(), MakeTransfers(), ""))
+	defer server.Close()
+	response, _ = Request(t, "GET", server.URL+"/files", nil, http.Header{"Authorization": {"Bearer "}})
+	ErrorIf(t, response.StatusCode != http.StatusUnauthorized, "An empty token should never match")
+}
+
+// The token comes from a file, or from the environment, but never from the command line.
+func TestLoadAdminToken(t *testing.T) {
+	t.Setenv(AdminTokenVariable, " from-env\n")
+	token, err := LoadAdminToken("")
+	ErrorIf(t, err != nil || token != "from-env", "Token should be read from the environment")
+
+	path := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(path, []byte("from-file\n"), 0600)
+	token, err = LoadAdminToken(path)
+	ErrorIf(t, err != nil || token != "from-file", "Token file should take precedence")
+
+	_, err = LoadAdminToken(path + ".missing")
+	ErrorIf(t, err == nil, "Missing token files should fail")
+}
+
+func TestAdminFiles(t *testing.T) {
+	fs := MakeFileSystem()
+	server := httptest.NewServer(MakeAdmin(fs, MakeTransfers(), "letmein"))
+	defer server.Close()
+
+	upload := MakeTestContent(1, FullDataPayloadLength+10)
+	response, _ := Request(t, "PUT", server.URL+"/files/boot/image", upload, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusCreated, "Upload failed")
+	response, _ = Request(t, "PUT", server.URL+"/files/boot/image", upload, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusConflict, "Uploading over a file should conflict")
+
+	var files []FileInfo
+	_, body := Request(t, "GET", server.URL+"/files", nil, AdminHeader)
+	json.Unmarshal(body, &files)
+	ErrorIf(t, len(files) != 1 || files[0].Filename != "boot/image", "Upload not listed")
+	ErrorIf(t, files[0].Size != len(upload), "Listed size wrong")
+	ErrorIf(t, files[0].Uploader == "" || files[0].Created.IsZero(), "Uploader and creation time should be listed")
+
+	var entries []DirEntry
+	_, body = Request(t, "GET", server.URL+"/files?dir=boot", nil, AdminHeader)
+	json.Unmarshal(body, &entries)
+	ErrorIf(t, len(entries) != 1 || entries[0].Name != "image" || entries[0].Size != len(upload), "Directory not listed")
+	response, _ = Request(t, "GET", server.URL+"/files?dir=missing", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNotFound, "Listing a missing directory should not be found")
+
+	response, _ = Request(t, "POST", server.URL+"/files/boot/image?to=boot/old", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNoContent, "Rename failed")
+	_, err := fs.GetReader("boot/old")
+	ErrorIf(t, err != nil, "Renamed file should be readable under its new name")
+
+	response, _ = Request(t, "DELETE", server.URL+"/files/boot/old", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNoContent, "Delete failed")
+	response, _ = Request(t, "DELETE", server.URL+"/files/boot/old", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNotFound, "Deleting a missing file should not be found")
+}
+
+// Transfers in progress are listed with their progress, and can be aborted.
+func TestAdminTransfers(t *testing.T) {
+	fs := MakeFileSystem()
+	transfers := MakeTransfers()
+	server := httptest.NewServer(MakeAdmin(fs, transfers, "letmein"))
+	defer server.Close()
+
+	client := MakeTestClient(nil)
+	options := &ConnectionOptions{Host: "127.0.0.1", Timeout: time.Second, MaxRetries: 3}
+	c, err := MakeConnection(options, client.conn.LocalAddr().(*net.UDPAddr), MarshalPacket(&WriteRequestPacket{RequestPacket{"upload", "octet", nil}}), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers.Add(c)
+	go func() {
+		c.Listen()
+		transfers.Remove(c)
+	}()
+
+	client.VerifyReceived(MarshalPacket(&AckPacket{0}))
+	client.SendSession(MarshalPacket(&DataPacket{1, MakeTestContent(1, FullDataPayloadLength)}))
+	client.VerifyReceived(MarshalPacket(&AckPacket{1}))
+
+	var listed []TransferInfo
+	_, body := Request(t, "GET", server.URL+"/transfers", nil, AdminHeader)
+	json.Unmarshal(body, &listed)
+	ErrorIf(t, len(listed) != 1, "Transfer not listed")
+	ErrorIf(t, listed[0].Kind != "write" || listed[0].Filename != "upload", "Transfer described wrong")
+	ErrorIf(t, listed[0].Block != 1 || listed[0].Bytes != FullDataPayloadLength, "Transfer progress wrong")
+
+	response, _ := Request(t, "DELETE", server.URL+"/transfers/42", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNotFound, "Aborting a missing transfer should not be found")
+	response, _ = Request(t, "DELETE", server.URL+"/transfers/1", nil, AdminHeader)
+	ErrorIf(t, response.StatusCode != http.StatusNoContent, "Abort failed")
+
+	client.VerifyReceived(MarshalPacket(&ErrorPacket{ERR_UNDEFINED, "Transfer aborted"}))
+	time.Sleep(50 * time.Millisecond)
+	ErrorIf(t, len(transfers.List()) != 0, "Aborted transfer should no longer be listed")
+	ErrorIf(t, len(fs.List()) != 0, "Aborted upload should be discarded")
+}
@@ -0,0 +1,252 @@
+// Archive.go serves files straight out of tar, tar.gz and zip archives, so boot bundles don't have to be unpacked.
+// An archive is mounted under a prefix as a read-only directory tree: with boot.tar mounted under "boot/",
+// a request for boot/pxelinux.0 reads the member pxelinux.0. Members are streamed block by block as they're
+// read, and never extracted.
+// Members of plain tar and zip archives are read in place. Compressed tar archives can't be read from the middle,
+// so they're decompressed from the start up to the member each time one is read.
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// The members of an archive, keyed by their path in the archive.
+type Archive interface {
+	// Returns the content of the member, or a nil reader if there's no such member.
+	Open(name string) (io.Reader, error)
+}
+
+// A ContentProvider serving the members of an archive under a prefix.
+type ArchiveProvider struct {
+	Prefix  string
+	Archive Archive
+}
+
+func (p *ArchiveProvider) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	name, underPrefix := strings.CutPrefix(filename, p.Prefix)
+	if !underPrefix {
+		return nil, nil
+	}
+	return p.Archive.Open(CleanMemberName(name))
+}
+
+// Mounts archives given like "boot/=boot.tar.gz,ipxe/=ipxe.zip".
+func MountArchives(providers *ContentProviders, spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		prefix, path, found := strings.Cut(entry, "=")
+		if !found {
+			return fmt.Errorf("Expected prefix=archive, got %q", entry)
+		}
+
+		archive, err := OpenArchive(path)
+		if err != nil {
+			return err
+		}
+		providers.AddPrefix(prefix, &ArchiveProvider{Prefix: prefix, Archive: archive})
+		Log.Println("Mounted", path, "under", prefix)
+	}
+	return nil
+}
+
+// Opens an archive, telling what kind it is from its extension.
+func OpenArchive(path string) (Archive, error) {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		return OpenZipArchive(path)
+	case strings.HasSuffix(path, ".tar"):
+		return OpenTarArchive(path)
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return OpenCompressedTarArchive(path)
+	default:
+		return nil, fmt.Errorf("Don't know what kind of archive %s is", path)
+	}
+}
+
+// Archives often name their members ./like/this, while clients may ask for /like/this.
+func CleanMemberName(name string) string {
+	return strings.TrimLeft(strings.TrimPrefix(name, "./"), "/")
+}
+
+type ZipArchive struct {
+	Members map[string]*zip.File
+}
+
+func OpenZipArchive(path string) (*ZipArchive, error) {
+	reader, err := zip.OpenReader(path) // Kept open for as long as we serve the archive.
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &ZipArchive{Members: make(map[string]*zip.File)}
+	for _, member := range reader.File {
+		if !member.FileInfo().IsDir() {
+			archive.Members[CleanMemberName(member.Name)] = member
+		}
+	}
+	return archive, nil
+}
+
+func (a *ZipArchive) Open(name string) (io.Reader, error) {
+	member := a.Members[name]
+	if member == nil {
+		return nil, nil
+	}
+
+	stream, err := member.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &ClosingReader{Stream: stream}, nil
+}
+
+// Members are read in place, with reads of different members sharing the archive.
+type TarArchive struct {
+	File    *os.File
+	Members map[string]*io.SectionReader
+}
+
+func OpenTarArchive(path string) (*TarArchive, error) {
+	file, err := os.Open(path) // Kept open for as long as we serve the archive.
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &TarArchive{File: file, Members: make(map[string]*io.SectionReader)}
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return archive, nil
+		}
+		if err != nil && err != tar.ErrInsecurePath {
+			file.Close()
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// The reader stops at the start of the member's content.
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		archive.Members[CleanMemberName(header.Name)] = io.NewSectionReader(file, offset, header.Size)
+	}
+}
+
+func (a *TarArchive) Open(name string) (io.Reader, error) {
+	member := a.Members[name]
+	if member == nil {
+		return nil, nil
+	}
+	// Each read gets its own position in the member.
+	return io.NewSectionReader(member, 0, member.Size()), nil
+}
+
+type CompressedTarArchive struct {
+	Path    string
+	Members map[string]bool
+}
+
+// Lists the members up front, so requests for files that aren't in the archive don't decompress it.
+func OpenCompressedTarArchive(path string) (*CompressedTarArchive, error) {
+	archive := &CompressedTarArchive{Path: path, Members: make(map[string]bool)}
+
+	file, reader, err := archive.openReader()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return archive, nil
+		}
+		if err != nil && err != tar.ErrInsecurePath {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			archive.Members[CleanMemberName(header.Name)] = true
+		}
+	}
+}
+
+func (a *CompressedTarArchive) openReader() (*os.File, *tar.Reader, error) {
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decompressed, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, tar.NewReader(decompressed), nil
+}
+
+func (a *CompressedTarArchive) Open(name string) (io.Reader, error) {
+	if !a.Members[name] {
+		return nil, nil
+	}
+
+	file, reader, err := a.openReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := reader.Next()
+		if err != nil && err != tar.ErrInsecurePath {
+			file.Close()
+			if err == io.EOF {
+				err = fmt.Errorf("%s is no longer in %s", name, a.Path)
+			}
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeReg && CleanMemberName(header.Name) == name {
+			return &ClosingReader{Stream: reader, Closer: file}, nil
+		}
+	}
+}
+
+// Closes what it's reading from once it's been read to the end, or fails, or the read is abandoned.
+type ClosingReader struct {
+	Stream io.Reader
+	Closer io.Closer // The Stream itself if nil.
+	Closed bool
+}
+
+func (r *ClosingReader) Read(buffer []byte) (int, error) {
+	bytesRead, err := r.Stream.Read(buffer)
+	if err != nil {
+		r.Close()
+	}
+	return bytesRead, err
+}
+
+func (r *ClosingReader) Close() error {
+	if r.Closed {
+		return nil
+	}
+	r.Closed = true
+
+	closer := r.Closer
+	if closer == nil {
+		closer, _ = r.Stream.(io.Closer)
+	}
+	if closer != nil {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes an archive holding the files, plus a directory, in the format its extension names.
+func WriteTestArchive(t *testing.T, path string, files map[string][]byte) {
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if filepath.Ext(path) == ".zip" {
+		archive := zip.NewWriter(out)
+		archive.Create("dir/")
+		for name, content := range files {
+			w, _ := archive.Create(name)
+			w.Write(content)
+		}
+		archive.Close()
+		return
+	}
+
+	var w io.Writer = out
+	if filepath.Ext(path) == ".gz" {
+		compressed := gzip.NewWriter(out)
+		defer compressed.Close()
+		w = compressed
+	}
+	archive := tar.NewWriter(w)
+	archive.WriteHeader(&tar.Header{Name: "./dir/", Typeflag: tar.TypeDir, Mode: 0755})
+	for name, content := range files {
+		archive.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		archive.Write(content)
+	}
+	archive.Close()
+}
+
+func TestArchives(t *testing.T) {
+	h := TestHarness{t}
+	dir := t.TempDir()
+	kernel := MakeTestContent(1, 3*FullDataPayloadLength+7)
+	files := map[string][]byte{"./dir/kernel": kernel, "pxelinux.0": []byte("loader")}
+
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "tar/stored", []byte("stored"))
+
+	providers := MakeContentProviders()
+	for _, name := range []string{"boot.tar", "boot.tar.gz", "boot.zip"} {
+		WriteTestArchive(t, filepath.Join(dir, name), files)
+	}
+	err := MountArchives(providers, "tar/="+filepath.Join(dir, "boot.tar")+",tgz/="+filepath.Join(dir, "boot.tar.gz")+",zip/="+filepath.Join(dir, "boot.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"tar/", "tgz/", "zip/"} {
+		// Members are read block by block, however the archive named them.
+		rs := MakeReadSession(fs)
+		rs.Providers = providers
+		h.Verify(rs, &ReadRequestPacket{RequestPacket{prefix + "dir/kernel", "octet", nil}}, &DataPacket{1, kernel[:FullDataPayloadLength]})
+		h.Verify(rs, &AckPacket{1}, &DataPacket{2, kernel[FullDataPayloadLength : 2*FullDataPayloadLength]})
+		h.Verify(rs, &AckPacket{2}, &DataPacket{3, kernel[2*FullDataPayloadLength : 3*FullDataPayloadLength]})
+		h.Verify(rs, &AckPacket{3}, &DataPacket{4, kernel[3*FullDataPayloadLength:]})
+		h.Verify(rs, &AckPacket{4}, nil)
+		h.VerifyDead(rs)
+
+		rs = MakeReadSession(fs)
+		rs.Providers = providers
+		h.Verify(rs, &ReadRequestPacket{RequestPacket{prefix + "/pxelinux.0", "octet", nil}}, &DataPacket{1, []byte("loader")})
+
+		// Directories aren't files.
+		rs = MakeReadSession(fs)
+		rs.Providers = providers
+		h.Verify(rs, &ReadRequestPacket{RequestPacket{prefix + "dir", "octet", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+	}
+
+	// Files that aren't in the archive are looked for in the store.
+	rs := MakeReadSession(fs)
+	rs.Providers = providers
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"tar/stored", "octet", nil}}, &DataPacket{1, []byte("stored")})
+
+	ErrorIf(t, MountArchives(MakeContentProviders(), "boot.rar") == nil, "Mounts without a prefix should fail")
+	ErrorIf(t, MountArchives(MakeContentProviders(), "x/=boot.rar") == nil, "Unknown kinds of archive should fail")
+	ErrorIf(t, MountArchives(MakeContentProviders(), "x/="+filepath.Join(dir, "missing.zip")) == nil, "Missing archives should fail")
+}
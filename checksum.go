@@ -0,0 +1,138 @@
+// Checksum.go computes checksums of uploads as they arrive, so we can tell whether a file arrived intact.
+// SHA-256 is always computed, and CRC32 and MD5 can be too. Each checksum can be read from a virtual
+// sidecar file named after the file, e.g. image.bin.sha256, in the format sha256sum and friends read:
+//   <hex>  image.bin
+// Uploads can also be checked against a manifest of expected SHA-256s in the same format, and are refused
+// if they don't match.
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"md5":    md5.New,
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+type Integrity struct {
+	Algorithms []string          // Computed as well as SHA-256.
+	Expected   map[string]string // SHA-256s uploads must match, keyed by filename.
+}
+
+// Parses a list of algorithms like "md5,crc32".
+func ParseChecksumAlgorithms(spec string) ([]string, error) {
+	var algorithms []string
+	for _, algorithm := range strings.Split(spec, ",") {
+		if algorithm == "" || algorithm == "sha256" {
+			continue
+		}
+		if ChecksumAlgorithms[algorithm] == nil {
+			return nil, fmt.Errorf("Unknown checksum algorithm %q", algorithm)
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+// Parses a manifest in the format sha256sum writes.
+func ParseManifest(r io.Reader) (map[string]string, error) {
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		sum, filename, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("Expected a checksum and a filename, got %q", line)
+		}
+		// sha256sum marks files it read in binary mode with a *.
+		filename = strings.TrimPrefix(strings.TrimLeft(filename, " "), "*")
+		manifest[filename] = strings.ToLower(sum)
+	}
+
+	return manifest, scanner.Err()
+}
+
+func LoadManifest(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseManifest(file)
+}
+
+// Makes a hash for SHA-256 and each of the other algorithms.
+func (i *Integrity) NewHashes() map[string]hash.Hash {
+	hashes := map[string]hash.Hash{"sha256": sha256.New()}
+	for _, algorithm := range i.Algorithms {
+		hashes[algorithm] = ChecksumAlgorithms[algorithm]()
+	}
+	return hashes
+}
+
+// Returns the checksums in hex, keyed by algorithm.
+func SumHashes(hashes map[string]hash.Hash) map[string]string {
+	sums := make(map[string]string, len(hashes))
+	for algorithm, h := range hashes {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// Computes the checksums of a file all at once, for files that weren't uploaded through a WriteSession.
+func (i *Integrity) Compute(file *File) map[string]string {
+	hashes := i.NewHashes()
+	for page := file.Pages.Front(); page != nil; page = page.Next() {
+		for _, h := range hashes {
+			h.Write(page.Value.([]byte))
+		}
+	}
+	return SumHashes(hashes)
+}
+
+// Checks the file against the manifest, if it's in it.
+func (i *Integrity) Verify(file *File) *ErrorPacket {
+	expected, listed := i.Expected[file.Filename]
+	if listed && file.Checksums["sha256"] != expected {
+		Log.Println("Refused", file.Filename, "since its SHA-256", file.Checksums["sha256"], "isn't", expected)
+		return &ErrorPacket{ERR_UNDEFINED, "Checksum mismatch"}
+	}
+	return nil
+}
+
+// Returns a sidecar file holding a checksum of the file the filename names, like image.bin.sha256, or nil
+// if the filename doesn't name one. Must be called with the lock held.
+func (f *FileSystem) sidecar(filename string) *File {
+	dot := strings.LastIndex(filename, ".")
+	if dot < 0 {
+		return nil
+	}
+
+	file := f.lookup(filename[:dot])
+	if file == nil {
+		return nil
+	}
+	sum, hasSum := file.Checksums[filename[dot+1:]]
+	if !hasSum {
+		return nil
+	}
+
+	return MakeVirtualFile(filename, file.Created, []byte(sum+"  "+filename[:dot]+"\n"))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+func TestUploadChecksums(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Integrity.Algorithms = []string{"md5", "crc32"}
+	content := MakeTestContent(1, FullDataPayloadLength+10)
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"images/fw.bin", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, content[:FullDataPayloadLength]}, &AckPacket{1})
+	h.Verify(ws, &DataPacket{1, content[:FullDataPayloadLength]}, nil) // Duplicates aren't hashed twice.
+	h.Verify(ws, &DataPacket{2, content[FullDataPayloadLength:]}, &AckPacket{2})
+
+	sha := sha256.Sum256(content)
+	sum := md5.Sum(content)
+	checksums := fs.Files["images/fw.bin"].Checksums
+	ErrorIf(t, checksums["sha256"] != hex.EncodeToString(sha[:]), "SHA-256 wrong")
+	ErrorIf(t, checksums["md5"] != hex.EncodeToString(sum[:]), "MD5 wrong")
+	ErrorIf(t, checksums["crc32"] != fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), "CRC32 wrong")
+
+	// The checksums can be read over TFTP.
+	rs := MakeReadSession(fs)
+	sidecar := hex.EncodeToString(sha[:]) + "  images/fw.bin\n"
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"images/fw.bin.sha256", "octet", nil}}, &DataPacket{1, []byte(sidecar)})
+	ErrorIf(t, ReadTestFile(fs, "images/fw.bin.md5") != hex.EncodeToString(sum[:])+"  images/fw.bin\n", "MD5 sidecar wrong")
+	ErrorIf(t, ReadTestFile(fs, "images/fw.bin.sha1") != "", "Unknown algorithms should have no sidecar")
+	ErrorIf(t, ReadTestFile(fs, "missing.sha256") != "", "Missing files should have no sidecar")
+
+	// Real files are read before sidecars, and files stored other ways get checksums too.
+	StoreTestFile(fs, "images/fw.bin.sha256", []byte("real"))
+	ErrorIf(t, ReadTestFile(fs, "images/fw.bin.sha256") != "real", "Real files should be read before sidecars")
+	stored := sha256.Sum256([]byte("real"))
+	ErrorIf(t, fs.Files["images/fw.bin.sha256"].Checksums["sha256"] != hex.EncodeToString(stored[:]), "Stored files should have checksums")
+
+	// And they survive a snapshot.
+	var archive bytes.Buffer
+	WriteSnapshot(fs, &archive)
+	restored := MakeFileSystem()
+	if err := ReadSnapshot(restored, &archive); err != nil {
+		t.Fatal(err)
+	}
+	ErrorIf(t, restored.Files["images/fw.bin"].Checksums["md5"] != checksums["md5"], "Snapshot should keep the checksums")
+}
+
+func TestChecksumManifest(t *testing.T) {
+	h := TestHarness{t}
+	content := []byte("the right firmware")
+	sha := sha256.Sum256(content)
+
+	manifest, err := ParseManifest(strings.NewReader("# Release 1.2\n" + strings.ToUpper(hex.EncodeToString(sha[:])) + " *fw.bin\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseManifest(strings.NewReader("nonsense\n"))
+	ErrorIf(t, err == nil, "Lines without a filename should fail to parse")
+
+	fs := MakeFileSystem()
+	fs.Integrity.Expected = manifest
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"fw.bin", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("the wrong firmware")}, &ErrorPacket{ERR_UNDEFINED, "Checksum mismatch"})
+	ErrorIf(t, fs.Files["fw.bin"] != nil || fs.Usage.Bytes != 0, "Mismatched uploads should be discarded")
+
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"fw.bin", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, content}, &AckPacket{1})
+
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"unlisted", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("anything")}, &AckPacket{1})
+}
@@ -7,6 +7,9 @@ package main
 import (
 	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,29 +19,55 @@ type ConnectionOptions struct {
 	IntroductionPort int
 	MaxRetries       int
 	Timeout          time.Duration
+	DallyPeriod      time.Duration     // How long to linger after the final ACK of an upload.
+	Multicast        *MulticastGroups  // Nil if the multicast option is disabled.
+	Remap            *Remapper         // Nil if filenames aren't remapped.
+	Providers        *ContentProviders // Nil if all files come from the FileSystem.
+	Transfers        *Transfers        // Nil if connections aren't tracked.
 }
 
 // Represents our side of the UDP connection with the remote host.
 type Connection struct {
 	LastReplyPacket []byte
+	FirstPacket     []byte // The request, handled once the connection starts listening.
 	Conn            *net.UDPConn
 	Handler         PacketHandler
 	RemoteAddr      *net.UDPAddr
 	MaxRetries      int
 	Timeout         time.Duration
+	DallyPeriod     time.Duration
+	ResendDeadline  time.Time // When LastReplyPacket is assumed lost and is re-sent.
+	LastStrayReply  time.Time // When we last told a stray host it has the wrong TID.
+	Id              int       // Assigned when the connection is tracked.
+	Started         time.Time
+	Aborted         atomic.Bool
+	Cancelled       chan struct{} // Closed when the connection is aborted, to wake the session if it's waiting.
+	Progress        TransferInfo  // As of the last packet handled.
+	sync.Mutex                    // Guards Progress, so the connection can be described while it runs.
 }
 
+// Minimum time between ERROR replies to hosts sending to our port with the wrong TID.
+const StrayReplyInterval = 100 * time.Millisecond
+
 // Listens for packets for the lifetime of the connection.
 // - Receives packets from the remote host, and dispatches them to the session backing the connection
 //   to get a reply.
 // - Sends replies back to the remote host. If we haven't heard from the remote host and time out,
 //   we assume our reply got lost and re-send.
 // - Once the connection is done, due to success, error or timing out too much, we return and the connection
-//   is destroyed.
+//   is destroyed. If the session asks, we dally first to answer the remote host in case our last reply was lost.
 func (c *Connection) Listen() {
-	defer c.Conn.Close()
+	defer c.Close()
+
+	// The request is handled here rather than by the listener, since opening the file can take a while,
+	// e.g. when it's fetched from an origin, and other clients shouldn't wait for it.
+	if c.Handler != nil {
+		c.LastReplyPacket = ProcessPacket(c.Handler, c.FirstPacket)
+		c.updateProgress()
+	}
 
 	retries := 0
+	send := true // The first reply packet of the connection is always sent.
 
 	for {
 		// Immediately terminate if over the retry limit.
@@ -48,15 +77,24 @@ func (c *Connection) Listen() {
 
 		// Transmit the first reply packet of the connection, any new reply packet
 		// or re-transmit a lost packet.
-		if c.LastReplyPacket != nil {
-			_, err := c.Conn.WriteToUDP(c.LastReplyPacket, c.RemoteAddr)
-			if err != nil {
-				Log.Println("Writing packet failed due to", err)
+		if send {
+			if c.LastReplyPacket != nil {
+				_, err := c.Conn.WriteToUDP(c.LastReplyPacket, c.RemoteAddr)
+				if err != nil {
+					Log.Println("Writing packet failed due to", err)
+				}
 			}
+			c.ResendDeadline = time.Now().Add(c.Timeout)
 		}
 
 		// Terminate the connection if the packet handler is done with it (normally or abnormally).
-		if c.Handler == nil || c.Handler.WantsToDie() {
+		if c.Handler == nil {
+			return
+		}
+		if c.Handler.WantsToDie() {
+			if c.Handler.WantsToDally() {
+				c.Dally()
+			}
 			return
 		}
 
@@ -68,11 +106,60 @@ func (c *Connection) Listen() {
 			return
 		}
 
-		if data != nil {
-			c.LastReplyPacket = ProcessPacket(c.Handler, data)
-		} else {
-			// We timed out, so up the retry counter.
+		if c.Aborted.Load() {
+			c.SendAbort()
+			return
+		}
+
+		if data == nil {
+			// We timed out, so up the retry counter and re-send.
 			retries++
+			send = true
+			continue
+		}
+
+		// Duplicate packets get no reply of their own, and leave the last reply pending for
+		// re-transmission. Answering a duplicate ACK with DATA is what causes the Sorcerer's
+		// Apprentice syndrome, where every DATA packet from then on is sent twice.
+		reply := ProcessPacket(c.Handler, data)
+		c.updateProgress()
+		send = reply != nil
+		if send {
+			// The remote host made progress, so it gets a fresh set of retries.
+			c.LastReplyPacket = reply
+			retries = 0
+		}
+	}
+}
+
+// Closes the connection, and lets the session release what it holds, e.g. an unfinished upload.
+func (c *Connection) Close() {
+	c.Conn.Close()
+
+	if c.Handler != nil {
+		c.Handler.Close()
+	}
+}
+
+// Lingers for the dally period after the session is done, so that if the remote host didn't get
+// our last reply and re-sends its last packet, the session can answer it again.
+// Nothing is re-sent on timeout, since the remote host never acknowledges the last reply.
+func (c *Connection) Dally() {
+	c.ResendDeadline = time.Now().Add(c.DallyPeriod)
+
+	for {
+		data, err := c.TryRead()
+		if err != nil || data == nil || c.Aborted.Load() {
+			return
+		}
+
+		reply := ProcessPacket(c.Handler, data)
+		c.updateProgress()
+		if reply != nil {
+			_, err := c.Conn.WriteToUDP(reply, c.RemoteAddr)
+			if err != nil {
+				Log.Println("Writing packet failed due to", err)
+			}
 		}
 	}
 }
@@ -82,25 +169,194 @@ func (c *Connection) Listen() {
 func (c *Connection) TryRead() ([]byte, error) {
 	buffer := make([]byte, MaxPacketSize)
 
-	// Make the read attempt time out after a while so we can retry our send.
-	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
-	bytesRead, clientAddr, err := c.Conn.ReadFromUDP(buffer)
+	// Make the read attempt time out when our last send is due to be retried.
+	// Packets that don't get a reply don't extend the deadline, so they can't stall our retries.
+	c.Conn.SetReadDeadline(c.ResendDeadline)
+
+	// Abort() wakes us by moving the deadline, which we may have just moved back.
+	if c.Aborted.Load() {
+		return nil, nil
+	}
+
+	for {
+		bytesRead, clientAddr, err := c.Conn.ReadFromUDP(buffer)
+
+		if err != nil {
+			opError, isOpError := err.(*net.OpError)
+			if isOpError && opError.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		// Requests sent to this port by other TID's get an error, but are otherwise ignored.
+		// Other hosts should not be able to make our connection fail.
+		if !clientAddr.IP.Equal(c.RemoteAddr.IP) || clientAddr.Port != c.RemoteAddr.Port {
+			c.ReplyToStranger(clientAddr)
+			continue
+		}
+
+		return buffer[:bytesRead], nil
+	}
+}
+
+// Tells a host that isn't our remote host that it has the wrong TID.
+// The RFC asks for this reply, but since the source address of a UDP packet is easily
+// forged, we send at most one per StrayReplyInterval so we can't be used to reflect traffic.
+func (c *Connection) ReplyToStranger(addr *net.UDPAddr) {
+	now := time.Now()
+	if now.Sub(c.LastStrayReply) < StrayReplyInterval {
+		return
+	}
+	c.LastStrayReply = now
+
+	reply := MarshalPacket(&ErrorPacket{ERR_UNKNOWN_TRANSFER_ID, "Unknown transfer ID"})
+	_, err := c.Conn.WriteToUDP(reply, addr)
+	if err != nil {
+		Log.Println("Writing packet to stray host failed due to", err)
+	}
+}
+
+// Stops the transfer from another goroutine. The remote host is sent an ERROR, and an upload
+// is discarded, since it's never committed.
+func (c *Connection) Abort() {
+	if c.Aborted.CompareAndSwap(false, true) {
+		close(c.Cancelled) // Wake the session if it's waiting, e.g. for a block of an upload it's following.
+	}
+	c.Conn.SetReadDeadline(time.Now()) // Wake the connection if it's waiting to read.
+}
 
+func (c *Connection) SendAbort() {
+	Log.Println("Aborted transfer", c.Id, "with", c.RemoteAddr)
+	_, err := c.Conn.WriteToUDP(MarshalPacket(&ErrorPacket{ERR_UNDEFINED, "Transfer aborted"}), c.RemoteAddr)
 	if err != nil {
-		opError, isOpError := err.(*net.OpError)
-		if isOpError && opError.Timeout() {
-			return nil, nil
+		Log.Println("Writing packet failed due to", err)
+	}
+}
+
+// Describes a transfer in progress.
+type TransferInfo struct {
+	Id       int       `json:"id"`
+	Client   string    `json:"client"`
+	Kind     string    `json:"kind"` // "read" or "write", or empty if the request was refused.
+	Filename string    `json:"filename"`
+	Block    uint16    `json:"block"` // The last block sent or received.
+	Bytes    int       `json:"bytes"` // Bytes transferred so far, counting whole blocks.
+	Size     int       `json:"size"`  // Length of the file being read, or -1 if it isn't known.
+	Started  time.Time `json:"started"`
+}
+
+// Describes the transfer as of the last packet. Sessions aren't locked while they handle packets, since they can
+// take a long time, e.g. waiting for the next block of an upload they're following, so progress is recorded
+// after each one instead.
+func (c *Connection) Describe() TransferInfo {
+	c.Lock()
+	defer c.Unlock()
+
+	info := c.Progress
+	info.Id = c.Id
+	return info
+}
+
+// Records how far the session has got, for Describe.
+func (c *Connection) updateProgress() {
+	progress := c.describeHandler()
+	c.Lock()
+	c.Progress = progress
+	c.Unlock()
+}
+
+// Must only be called by the connection's own goroutine, or before it starts.
+func (c *Connection) describeHandler() TransferInfo {
+	info := TransferInfo{Client: c.RemoteAddr.String(), Size: -1, Started: c.Started}
+
+	switch s := c.Handler.(type) {
+	case *ReadSession:
+		info.Kind, info.Filename = "read", s.Filename
+		if s.Reader != nil {
+			info.Block = s.Reader.GetBlock()
+			info.Bytes = int(info.Block) * FullDataPayloadLength
+		}
+		if fileReader, isFile := s.Reader.(*FileReader); isFile {
+			info.Size = fileReader.File.Size
+			if info.Bytes > info.Size {
+				info.Bytes = info.Size
+			}
+		}
+	case *WriteSession:
+		info.Kind, info.Filename = "write", s.Filename
+		if s.Writer != nil {
+			info.Block = s.Writer.GetNumBlocks()
+			info.Bytes = s.Writer.Size
 		}
-		return nil, err
 	}
 
-	// Ignore requests sent to this port by other TID's.
-	// Other hosts should not be able to make our connection fail.
-	if !clientAddr.IP.Equal(c.RemoteAddr.IP) || clientAddr.Port != c.RemoteAddr.Port {
-		return nil, nil
+	return info
+}
+
+// The connections currently running, so they can be inspected and aborted.
+type Transfers struct {
+	Connections map[int]*Connection
+	NextId      int
+	sync.Mutex  // Guards Connections and NextId.
+}
+
+func MakeTransfers() *Transfers {
+	return &Transfers{Connections: make(map[int]*Connection), NextId: 1}
+}
+
+// Starts tracking a connection, giving it an ID. A nil Transfers tracks nothing.
+func (t *Transfers) Add(c *Connection) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	c.Id = t.NextId
+	t.NextId++
+	t.Connections[c.Id] = c
+}
+
+func (t *Transfers) Remove(c *Connection) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.Connections, c.Id)
+}
+
+// Describes every running connection, oldest first.
+func (t *Transfers) List() []TransferInfo {
+	t.Lock()
+	connections := make([]*Connection, 0, len(t.Connections))
+	for _, c := range t.Connections {
+		connections = append(connections, c)
+	}
+	t.Unlock()
+
+	infos := make([]TransferInfo, 0, len(connections))
+	for _, c := range connections {
+		infos = append(infos, c.Describe())
 	}
 
-	return buffer[:bytesRead], nil
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// Aborts the connection with the ID. Returns false if there isn't one.
+func (t *Transfers) Abort(id int) bool {
+	t.Lock()
+	c := t.Connections[id]
+	t.Unlock()
+
+	if c == nil {
+		return false
+	}
+	c.Abort()
+	return true
 }
 
 // Creates a connection that will serve as our side of things.
@@ -114,6 +370,8 @@ func MakeConnection(options *ConnectionOptions, raddr *net.UDPAddr, firstPacket
 	}
 
 	c.RemoteAddr = raddr
+	c.Started = time.Now()
+	c.Cancelled = make(chan struct{})
 
 	conn, err := net.ListenUDP("udp", &laddr)
 	if err != nil {
@@ -121,7 +379,7 @@ func MakeConnection(options *ConnectionOptions, raddr *net.UDPAddr, firstPacket
 	}
 	c.Conn = conn
 
-	handler, err := MakeHandler(firstPacket, fs)
+	handler, err := MakeHandler(firstPacket, fs, options, raddr, c.Cancelled)
 
 	if err != nil {
 		// No way to handle this packet, but we can send an error to
@@ -133,16 +391,15 @@ func MakeConnection(options *ConnectionOptions, raddr *net.UDPAddr, firstPacket
 			})
 	} else {
 		c.Handler = handler
+		c.FirstPacket = firstPacket
 	}
 
-	if c.Handler != nil {
-		// Handle the first packet of information.
-		c.LastReplyPacket = ProcessPacket(c.Handler, firstPacket)
-	}
+	c.Progress = c.describeHandler()
 
 	// Todo: make configurable.
 	c.Timeout = options.Timeout
 	c.MaxRetries = options.MaxRetries
+	c.DallyPeriod = options.DallyPeriod
 
 	return c, nil
 }
@@ -150,21 +407,33 @@ func MakeConnection(options *ConnectionOptions, raddr *net.UDPAddr, firstPacket
 // Creates an RRQ or WRQ handler as appropriate, to handle the packet.
 // If the caller gave a bad opcode, we still need to spin up our Connection
 // long enough to best-effort send an error to the caller.
-func MakeHandler(packet []byte, fs *FileSystem) (PacketHandler, error) {
+func MakeHandler(packet []byte, fs *FileSystem, options *ConnectionOptions, raddr *net.UDPAddr, cancel <-chan struct{}) (PacketHandler, error) {
 	if len(packet) < 2 {
 		return nil, fmt.Errorf("Packet too short")
 	}
 
 	opcode := ConvertToUInt16(packet[:2])
 
+	var handler PacketHandler
+	var session *Session
+
 	switch opcode {
 	case PKT_RRQ:
-		return MakeReadSession(fs), nil
+		rs := MakeReadSession(fs)
+		rs.Providers = options.Providers
+		handler, session = rs, &rs.Session
 	case PKT_WRQ:
-		return MakeWriteSession(fs), nil
+		ws := MakeWriteSession(fs)
+		handler, session = ws, &ws.Session
 	default:
 		return nil, fmt.Errorf("Session must start with RRQ or RWQ")
 	}
+
+	session.RemoteAddr = raddr
+	session.Remap = options.Remap
+	session.Cancel = cancel
+
+	return handler, nil
 }
 
 // Listens indefinitely on the introduction port (i.e. port 69.)
@@ -194,11 +463,20 @@ func ListenForNewConnections(options *ConnectionOptions, fs *FileSystem) {
 		data := make([]byte, bytesRead)
 		copy(data, buffer[:bytesRead])
 
+		// Reads of the same file with the multicast option are served together.
+		if options.Multicast != nil && options.Multicast.TryJoin(options, clientAddr, data, fs) {
+			continue
+		}
+
 		// Now that somebody contacted us, go spin up a Connection and hand the packet we
 		// received over to it for processing.
 		c, err := MakeConnection(options, clientAddr, data, fs)
 		if err == nil {
-			go c.Listen()
+			options.Transfers.Add(c)
+			go func() {
+				c.Listen()
+				options.Transfers.Remove(c)
+			}()
 		} else {
 			Log.Println("Error creating connection:", err)
 		}
@@ -4,8 +4,10 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -94,6 +96,7 @@ func TestListen(t *testing.T) {
 	ResendTimeout(MakeTestClient(&serverAddr))
 	FirstPacketIsBad(MakeTestClient(&serverAddr))
 	MaxRetries(MakeTestClient(&serverAddr))
+	StrayPacket(MakeTestClient(&serverAddr), MakeTestClient(&serverAddr))
 }
 
 // This should serve as a basic end-to-end systems test to validate that the layers are wired up correctly.
@@ -132,3 +135,52 @@ func MaxRetries(client *TestClient) {
 	}
 	fmt.Println(err)
 }
+
+// A host sending to a connection it doesn't own gets ERR_UNKNOWN_TRANSFER_ID, and the
+// owner's transfer carries on undisturbed.
+func StrayPacket(client *TestClient, stranger *TestClient) {
+	client.SendServer([]byte{0, PKT_WRQ, 'c', 0, 'o', 'c', 't', 'a', 'l', 0})
+	client.VerifyReceived([]byte{0, PKT_ACK, 0, 0})
+
+	stranger.sessionAddr = client.sessionAddr
+	stranger.SendSession([]byte{0, PKT_DATA, 0, 1, 'x'})
+	received, err := stranger.AwaitReceive()
+	if err != nil {
+		panic(err)
+	}
+	if ConvertToUInt16(received[:2]) != PKT_ERROR || ConvertToUInt16(received[2:4]) != ERR_UNKNOWN_TRANSFER_ID {
+		panic(fmt.Errorf("Stranger received unexpected reply: %v", received))
+	}
+
+	client.SendSession([]byte{0, PKT_DATA, 0, 1, 'c'})
+	client.VerifyReceived([]byte{0, PKT_ACK, 0, 1})
+}
+
+// Opening a file can be slow, so requests are handled by their own connection, not while it's being made.
+func TestSlowRequest(t *testing.T) {
+	release := make(chan bool)
+	options := &ConnectionOptions{Host: "127.0.0.1", Timeout: time.Second, MaxRetries: 1, Providers: MakeContentProviders()}
+	options.Providers.AddFallback(ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		<-release
+		return strings.NewReader("slow"), nil
+	}))
+
+	client := MakeTestClient(nil)
+	made := make(chan *Connection, 1)
+	go func() {
+		c, err := MakeConnection(options, client.conn.LocalAddr().(*net.UDPAddr), MarshalPacket(&ReadRequestPacket{RequestPacket{"slow", "octet", nil}}), MakeFileSystem())
+		if err != nil {
+			panic(err)
+		}
+		made <- c
+	}()
+
+	select {
+	case c := <-made:
+		go c.Listen()
+	case <-time.After(time.Second):
+		t.Fatal("Making the connection waited for the file to open")
+	}
+	release <- true
+	client.VerifyReceived(MarshalPacket(&DataPacket{1, []byte("slow")}))
+}
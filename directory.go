@@ -0,0 +1,113 @@
+// Directory.go gives the flat FileSystem a hierarchy. Filenames are paths, and a directory holds every file whose
+// name starts with it and a slash, so directories exist for as long as they hold files and are never created or deleted.
+// With listings on, reading <dir>/.listing (or .listing, for the top) gives the directory's entries sorted by name,
+// one per line, as their size in bytes and their name. Subdirectories end in a slash and count every file under them:
+//   1048576 kernel
+//   2097152 images/
+// Only stored files are listed, not those served by providers or from layers.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ListingFilename = ".listing"
+
+// Describes a file or subdirectory in a directory.
+type DirEntry struct {
+	Name     string    `json:"name"`
+	IsDir    bool      `json:"isDir"`
+	Size     int       `json:"size"`     // For a directory, the size of every file under it.
+	Files    int       `json:"files"`    // For a directory, how many files are under it.
+	Modified time.Time `json:"modified"` // When the file, or the newest file under the directory, was committed.
+}
+
+// Lists the entries of the directory, sorted by name. The top directory is "".
+// Returns false if there's no such directory; the top always exists, even if it's empty.
+func (f *FileSystem) ReadDir(dir string) ([]DirEntry, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.readDir(dir)
+}
+
+// Must be called with the lock held.
+func (f *FileSystem) readDir(dir string) ([]DirEntry, bool) {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	// A file and a directory can have the same name, so directories are keyed with their slash.
+	entries := make(map[string]*DirEntry)
+	for filename, file := range f.Files {
+		rest, inDir := strings.CutPrefix(strings.TrimLeft(filename, "/"), prefix)
+		if !inDir || rest == "" {
+			continue
+		}
+
+		name, _, isDir := strings.Cut(rest, "/")
+		key := name
+		if isDir {
+			key += "/"
+		}
+
+		entry := entries[key]
+		if entry == nil {
+			entry = &DirEntry{Name: name, IsDir: isDir}
+			entries[key] = entry
+		}
+		entry.Size += file.Size
+		entry.Files++
+		if file.Created.After(entry.Modified) {
+			entry.Modified = file.Created
+		}
+	}
+
+	listing := make([]DirEntry, 0, len(entries))
+	for _, entry := range entries {
+		listing = append(listing, *entry)
+	}
+	sort.Slice(listing, func(i, j int) bool {
+		if listing[i].Name == listing[j].Name {
+			return !listing[i].IsDir
+		}
+		return listing[i].Name < listing[j].Name
+	})
+	return listing, prefix == "" || len(listing) > 0
+}
+
+// Returns the listing of a directory if the filename names one, like images/.listing, or nil.
+// Must be called with the lock held.
+func (f *FileSystem) listing(filename string) *File {
+	if !f.Listings {
+		return nil
+	}
+	dir, isListing := strings.CutSuffix(filename, ListingFilename)
+	if !isListing || (dir != "" && !strings.HasSuffix(dir, "/")) {
+		return nil
+	}
+
+	entries, exists := f.readDir(dir)
+	if !exists {
+		return nil
+	}
+
+	var content bytes.Buffer
+	var modified time.Time
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(&content, "%d %s\n", entry.Size, name)
+		if entry.Modified.After(modified) {
+			modified = entry.Modified
+		}
+	}
+	return MakeVirtualFile(filename, modified, content.Bytes())
+}
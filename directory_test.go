@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDirectories(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "kernel", []byte("0123456789"))
+	StoreTestFile(fs, "images/initrd", []byte("initrd"))
+	StoreTestFile(fs, "images/x86/boot.img", []byte("boot"))
+	StoreTestFile(fs, "images/x86/efi.img", []byte("efi"))
+
+	entries, exists := fs.ReadDir("images/")
+	ErrorIf(t, !exists || len(entries) != 2, "Expected 2 entries in images")
+	ErrorIf(t, entries[0].Name != "initrd" || entries[0].IsDir || entries[0].Size != 6, "Wrong file entry")
+	ErrorIf(t, entries[1].Name != "x86" || !entries[1].IsDir || entries[1].Size != 7 || entries[1].Files != 2, "Wrong directory entry")
+	ErrorIf(t, !entries[1].Modified.Equal(fs.Files["images/x86/efi.img"].Created), "Directories should be as new as their newest file")
+
+	_, exists = fs.ReadDir("/images")
+	ErrorIf(t, !exists, "Slashes around directories shouldn't matter")
+	_, exists = fs.ReadDir("missing")
+	ErrorIf(t, exists, "Directories without files shouldn't exist")
+	_, exists = MakeFileSystem().ReadDir("")
+	ErrorIf(t, !exists, "The top directory should always exist")
+
+	// Listings are off unless asked for.
+	rs := MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{".listing", "octet", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+
+	fs.Listings = true
+	rs = MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{".listing", "octet", nil}}, &DataPacket{1, []byte("13 images/\n10 kernel\n")})
+	ErrorIf(t, ReadTestFile(fs, "images/.listing") != "6 initrd\n7 x86/\n", "Wrong listing of images")
+	ErrorIf(t, ReadTestFile(fs, "images/x86/.listing") != "4 boot.img\n3 efi.img\n", "Wrong listing of images/x86")
+	ErrorIf(t, ReadTestFile(fs, "missing/.listing") != "", "Directories without files shouldn't have listings")
+	ErrorIf(t, ReadTestFile(fs, "images.listing") != "", "Listings should only be read inside directories")
+
+	// Real files are read before listings.
+	StoreTestFile(fs, "images/.listing", []byte("curated"))
+	ErrorIf(t, ReadTestFile(fs, "images/.listing") != "curated", "Real files should be read before listings")
+}
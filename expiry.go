@@ -0,0 +1,89 @@
+// Expiry.go deletes files once they've been stored for their time-to-live, so uploads like crash dumps
+// don't pile up forever. Files under a prefix can have their own TTL, with the longest prefix winning,
+// and other files get the default TTL. A zero TTL keeps files until they're deleted some other way.
+// A janitor looks for expired files periodically. Expired files are deleted like any other, so clients
+// already reading them carry on undisturbed.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Expiry struct {
+	Default  time.Duration
+	Prefixed map[string]time.Duration
+}
+
+// Parses TTLs for prefixes, given like "crash/=24h,configs/=720h".
+func ParsePrefixedTTLs(spec string) (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration)
+	if spec == "" {
+		return ttls, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		prefix, duration, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("Expected prefix=duration, got %q", entry)
+		}
+
+		ttl, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, err
+		}
+		ttls[prefix] = ttl
+	}
+
+	return ttls, nil
+}
+
+// Returns the TTL for the file.
+func (e *Expiry) TTL(filename string) time.Duration {
+	ttl, longest := e.Default, -1
+	for prefix, prefixTTL := range e.Prefixed {
+		if strings.HasPrefix(filename, prefix) && len(prefix) > longest {
+			ttl, longest = prefixTTL, len(prefix)
+		}
+	}
+	return ttl
+}
+
+// Returns when a file created at the time expires, or zero if it doesn't.
+func (e *Expiry) ExpiresAt(filename string, created time.Time) time.Time {
+	ttl := e.TTL(filename)
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return created.Add(ttl)
+}
+
+// Deletes the files that have expired by now, returning how many there were.
+// Older versions of files past their retention are pruned too.
+func (f *FileSystem) Expire(now time.Time) int {
+	f.Lock()
+	defer f.Unlock()
+
+	for filename := range f.History {
+		f.prune(filename, now)
+	}
+
+	expired := 0
+	for _, file := range f.Files {
+		if !file.Expires.IsZero() && !file.Expires.After(now) {
+			f.remove(file)
+			Log.Println("Expired file", file.Filename)
+			f.notifyRemoved(file.Filename)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Deletes expired files every interval.
+func RunJanitor(fs *FileSystem, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		fs.Expire(now)
+	}
+}
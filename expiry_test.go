@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPrefixedTTLs(t *testing.T) {
+	prefixed, err := ParsePrefixedTTLs("crash/=24h,crash/kernel/=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParsePrefixedTTLs("crash/")
+	ErrorIf(t, err == nil, "Entries without a duration should fail to parse")
+
+	expiry := Expiry{Default: time.Minute, Prefixed: prefixed}
+	ErrorIf(t, expiry.TTL("crash/app") != 24*time.Hour, "Prefix TTL wrong")
+	ErrorIf(t, expiry.TTL("crash/kernel/dump") != time.Hour, "Longest prefix should win")
+	ErrorIf(t, expiry.TTL("configs/switch") != time.Minute, "Default TTL wrong")
+	ErrorIf(t, !(&Expiry{}).ExpiresAt("foo", time.Now()).IsZero(), "Files without a TTL should never expire")
+}
+
+// Expired files are deleted, but anybody reading them can finish.
+func TestExpire(t *testing.T) {
+	fs := MakeFileSystem()
+	fs.Expiry = Expiry{Prefixed: map[string]time.Duration{"crash/": time.Hour}}
+	content := MakeTestContent(1, 2*FullDataPayloadLength+1)
+	StoreTestFile(fs, "crash/dump", content)
+	StoreTestFile(fs, "kept", []byte("forever"))
+
+	reader, _ := fs.GetReader("crash/dump")
+	ErrorIf(t, fs.Expire(time.Now()) != 0, "Nothing should have expired yet")
+	ErrorIf(t, fs.Expire(time.Now().Add(2*time.Hour)) != 1, "The dump should have expired")
+	ErrorIf(t, fs.Files["crash/dump"] != nil || fs.Files["kept"] == nil, "Wrong files expired")
+	ErrorIf(t, fs.Usage.Bytes != len("forever"), "Expired files should give back their space")
+
+	var read []byte
+	for {
+		read = append(read, reader.ReadBlock()...)
+		if reader.AtEnd() {
+			break
+		}
+		reader.AdvanceBlock()
+	}
+	ErrorIf(t, !bytes.Equal(read, content), "Reader of an expired file should be undisturbed")
+}
+
+func TestEvictLRU(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Quota.MaxBytes = 1400
+	fs.EvictLRU = true
+
+	StoreTestFile(fs, "a", MakeTestContent(1, 600))
+	StoreTestFile(fs, "b", MakeTestContent(2, 600))
+	fs.GetReader("a") // Now b is the least recently used.
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"c", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(3, 300)}, &AckPacket{1})
+	ErrorIf(t, fs.Files["b"] != nil, "Least recently used file should have been evicted")
+	ErrorIf(t, fs.Files["a"] == nil || fs.Files["c"] == nil, "Recently used files should be kept")
+	ErrorIf(t, fs.Usage.Bytes != 900, "Usage wrong after eviction")
+
+	// Uploads too large to fit even with everything evicted are refused without evicting anything.
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"huge", "octet", map[string]string{"tsize": "5000"}}}, &ErrorPacket{ERR_DISK_FULL, "Disk full"})
+	ErrorIf(t, len(fs.Files) != 2, "Nothing should be evicted for an upload that can't fit")
+}
@@ -5,17 +5,42 @@ package main
 
 import (
 	"container/list"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Provides file creation and access.
 type FileSystem struct {
 	Files      map[string]*File
-	sync.Mutex // Guards every file creation or access. There should not be much contention.
+	Generation uint64 // Counts changes to Files, so snapshots can tell when there's nothing new.
+	Quota      Quota
+	Usage      Usage
+	Expiry     Expiry
+	EvictLRU   bool      // Whether to evict the least recently used files to make room for uploads.
+	Recent     list.List // Committed files, most recently used at the front.
+	Versioning Versioning
+	History    map[string][]*File // Older versions of files, oldest first.
+	PageStore  *PageStore         // Where the pages of the files are stored.
+	Integrity  Integrity
+	Validators Validators       // Check uploads before they're committed (see validate.go).
+	Whiteouts  map[string]bool  // Names deleted from the layers under the FileSystem, if it's part of an Overlay.
+	Listings   bool             // Whether to serve directory listings as <dir>/.listing (see directory.go).
+	Hooks      *Hooks           // Told about uploads as they're committed, fail or are aborted.
+	Backups    *Hooks           // Told about committed uploads, deletions and renames on a queue of their own, e.g. the git store's.
+	LiveReads  bool             // Whether files can be read while they're uploaded (see follow.go).
+	Uploading  map[string]*File // Uploads that can be followed, keyed by filename.
+	sync.Mutex                  // Guards every file creation or access. There should not be much contention.
 }
 
 func MakeFileSystem() *FileSystem {
-	return &FileSystem{Files: make(map[string]*File)}
+	return &FileSystem{
+		Files:     make(map[string]*File),
+		Usage:     Usage{ClientBytes: make(map[string]int)},
+		History:   make(map[string][]*File),
+		PageStore: MakePageStore(),
+		Uploading: make(map[string]*File),
+	}
 }
 
 // Creates a file. Note: calling this method will not prevent other people from calling
@@ -24,48 +49,223 @@ func (f *FileSystem) CreateFile(filename string) (*File, *ErrorPacket) {
 	f.Lock()
 	defer f.Unlock()
 
-	if f.Files[filename] != nil {
+	if f.Files[filename] != nil && !f.Versioning.Enabled {
 		return nil, &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}
 	}
 
 	Log.Println("Began writing file", filename)
-	return &File{Filename: filename}, nil
+	file := &File{Filename: filename, Store: f.PageStore}
+	f.follow(file)
+	return file, nil
 }
 
+// Opens a file for reading. Old versions of a file can be read by asking for name@version or name@time,
+// and its checksums by asking for name.sha256 and so on.
 func (f *FileSystem) GetReader(filename string) (*FileReader, *ErrorPacket) {
 	f.Lock()
 	defer f.Unlock()
 
-	if f.Files[filename] == nil {
+	file := f.lookup(filename)
+	if file != nil {
+		f.Recent.MoveToFront(f.Files[file.Filename].Recent)
+	} else {
+		file = f.sidecar(filename)
+	}
+	if file == nil {
+		file = f.listing(filename)
+	}
+	if file == nil {
 		return nil, &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
 	}
 
-	file := f.Files[filename]
 	Log.Println("Began reading file", filename)
 	return &FileReader{
 		Block:   1,
 		Current: file.Pages.Front(),
+		File:    file,
 	}, nil
 }
 
 // Commits a file to the filesystem. The file must never be modified after this call is made.
 func (f *FileSystem) Commit(file *File) *ErrorPacket {
+	if file.Checksums == nil {
+		file.Checksums = f.Integrity.Compute(file)
+	}
+	if err := f.Integrity.Verify(file); err != nil {
+		return err
+	}
+
 	f.Lock()
 	defer f.Unlock()
 
-	if f.Files[file.Filename] != nil {
+	if f.Files[file.Filename] != nil && !f.Versioning.Enabled {
 		return &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}
 	}
 
-	f.Files[file.Filename] = file
+	file.Created = time.Now()
+	f.store(file)
+	f.unfollow(file, true)
 	Log.Println("Added file", file.Filename)
+	f.Hooks.Notify(MakeHookEvent(HookCommitted, file))
+	f.Backups.Notify(MakeHookEvent(HookCommitted, file))
+	return nil
+}
+
+// Adds a file to Files. A file already there with the same name becomes an older version.
+// Must be called with the lock held.
+func (f *FileSystem) store(file *File) {
+	// Files written other than through a WriteSession haven't reserved their space yet.
+	f.charge(file, file.Size-file.Reserved)
+	f.Usage.StoredBytes += file.Size
+
+	if existing := f.Files[file.Filename]; existing != nil {
+		f.Recent.Remove(existing.Recent)
+		existing.Recent = nil
+		f.History[file.Filename] = append(f.History[file.Filename], existing)
+		if file.Version == 0 {
+			file.Version = existing.Version + 1
+		}
+	} else if file.Version == 0 {
+		file.Version = 1
+	}
+
+	file.Expires = f.Expiry.ExpiresAt(file.Filename, file.Created)
+	file.Recent = f.Recent.PushFront(file)
+	f.Files[file.Filename] = file
+	delete(f.Whiteouts, file.Filename)
+	f.Generation++
+	f.prune(file.Filename, time.Now())
+}
+
+// Removes a file from Files, with all its older versions, giving back their space and their pages.
+// Must be called with the lock held.
+func (f *FileSystem) remove(file *File) {
+	for _, version := range f.unlink(file) {
+		version.Store.Release(version)
+	}
+}
+
+// Takes a file and its older versions out of Files and History, giving back their space but not their pages.
+// Returns them, oldest first. Must be called with the lock held.
+func (f *FileSystem) unlink(file *File) []*File {
+	versions := append(f.History[file.Filename], file)
+	for _, version := range versions {
+		f.release(version)
+	}
+
+	delete(f.History, file.Filename)
+	f.Recent.Remove(file.Recent)
+	delete(f.Files, file.Filename)
+	f.Generation++
+	return versions
+}
+
+// Gives back the space held by a stored file. Must be called with the lock held.
+func (f *FileSystem) release(file *File) {
+	f.charge(file, -file.Reserved)
+	f.Usage.StoredBytes -= file.Size
+}
+
+// Removes a file. Anybody already reading it can finish reading it.
+func (f *FileSystem) Delete(filename string) *ErrorPacket {
+	f.Lock()
+	defer f.Unlock()
+
+	// We can't tell whether the layers under an overlay have the file, so deleting from one always succeeds.
+	if f.Whiteouts != nil {
+		f.whiteOut(filename)
+	} else if f.Files[filename] == nil {
+		return &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
+	}
+
+	if file := f.Files[filename]; file != nil {
+		f.remove(file)
+	}
+	Log.Println("Deleted file", filename)
+	f.notifyRemoved(filename)
 	return nil
 }
 
+// Tells the backups a file is gone, whether it was deleted, expired or evicted, so they stop serving it too.
+// Must be called with the lock held, so they're told in order.
+func (f *FileSystem) notifyRemoved(filename string) {
+	f.Backups.Notify(&HookEvent{Event: HookDeleted, Filename: filename, Time: time.Now()})
+}
+
+func (f *FileSystem) Rename(from string, to string) *ErrorPacket {
+	f.Lock()
+	defer f.Unlock()
+
+	file := f.Files[from]
+	if file == nil {
+		return &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
+	}
+	if f.Files[to] != nil {
+		return &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}
+	}
+
+	// The file and its older versions are stored again under the new name, which may have a different TTL.
+	for _, version := range f.unlink(file) {
+		version.Filename = to
+		f.store(version)
+	}
+	f.whiteOut(from)
+	Log.Println("Renamed file", from, "to", to)
+	event := MakeHookEvent(HookRenamed, file)
+	event.From = from
+	f.Backups.Notify(event)
+	return nil
+}
+
+func (f *FileSystem) GetGeneration() uint64 {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.Generation
+}
+
+// Describes a committed file.
+type FileInfo struct {
+	Filename  string            `json:"filename"`
+	Size      int               `json:"size"`
+	Created   time.Time         `json:"created"`
+	Uploader  string            `json:"uploader"`
+	Version   int               `json:"version"`
+	Checksums map[string]string `json:"checksums"`
+}
+
+// Describes every committed file, sorted by filename.
+func (f *FileSystem) List() []FileInfo {
+	f.Lock()
+	defer f.Unlock()
+
+	infos := make([]FileInfo, 0, len(f.Files))
+	for _, file := range f.Files {
+		infos = append(infos, FileInfo{file.Filename, file.Size, file.Created, file.Uploader, file.Version, file.Checksums})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Filename < infos[j].Filename })
+	return infos
+}
+
+// Lets a ReadSession read a file block by block, whether it's stored or generated.
+type BlockReader interface {
+	GetBlock() uint16
+	ReadBlock() []byte
+	AdvanceBlock()
+	AtEnd() bool
+	Err() error // Non-nil if the file couldn't be read.
+}
+
 // Keeps track of the current block pointer and lets the reader advance forward.
 type FileReader struct {
 	Block   uint16
 	Current *list.Element
+	File    *File
+}
+
+func (r *FileReader) GetBlock() uint16 {
+	return r.Block
 }
 
 func (r *FileReader) ReadBlock() []byte {
@@ -82,8 +282,36 @@ func (r *FileReader) AtEnd() bool {
 	return r.Current.Next() == nil
 }
 
+// Stored files can always be read.
+func (r *FileReader) Err() error {
+	return nil
+}
+
+// Moves the reader to the given block, which must be between 1 and the number of blocks in the file.
+// Seeking backwards starts over from the first block, since pages are only linked forwards.
+func (r *FileReader) Seek(block uint16) {
+	if block < r.Block {
+		r.Block = 1
+		r.Current = r.File.Pages.Front()
+	}
+
+	for r.Block < block && !r.AtEnd() {
+		r.AdvanceBlock()
+	}
+}
+
 type File struct {
-	Filename string
+	Filename  string
+	Size      int               // Length of all the pages together.
+	Created   time.Time         // When the file was committed.
+	Uploader  string            // Address of the client that uploaded the file, if any.
+	Reserved  int               // Bytes of the quota held by the file.
+	Expires   time.Time         // When the file is deleted, or zero if it's kept until it's deleted some other way.
+	Recent    *list.Element     // The file's place in FileSystem.Recent, if it's the latest version.
+	Version   int               // Counts up from 1 each time a file with the same name is committed.
+	Store     *PageStore        // Where the file's pages are stored. Nil if they aren't shared with other files.
+	Checksums map[string]string // Hex checksums of the content, keyed by algorithm.
+	Growth    *Growth           // Non-nil if the file can be followed while it's uploaded.
 
 	// Each Page is a []byte chunk of the file.
 	// All pages are 512 bytes except for the last one, which may be less.
@@ -91,9 +319,29 @@ type File struct {
 }
 
 func (f *File) Append(data []byte) {
-	page := make([]byte, len(data))
-	copy(page, data)
-	f.Pages.PushBack(page)
+	if f.Growth != nil {
+		f.Growth.Lock()
+		defer f.Growth.Unlock()
+		defer f.Growth.Arrived.Broadcast()
+	}
+
+	f.Pages.PushBack(f.Store.Intern(data))
+	f.Size += len(data)
+}
+
+// Makes a file that's never committed, like a checksum sidecar or a directory listing, to be read like any other.
+func MakeVirtualFile(filename string, created time.Time, content []byte) *File {
+	file := &File{Filename: filename, Created: created}
+	for start := 0; ; start += FullDataPayloadLength {
+		end := start + FullDataPayloadLength
+		if end > len(content) {
+			end = len(content)
+		}
+		file.Append(content[start:end])
+		if end-start < FullDataPayloadLength {
+			return file
+		}
+	}
 }
 
 func (f *File) GetNumBlocks() uint16 {
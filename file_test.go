@@ -36,6 +36,25 @@ func TestBasicFileReadWrite(t *testing.T) {
 
 func ErrorIf(t *testing.T, condition bool, msg string) {
 	if condition {
-		t.Errorf(msg)
+		t.Error(msg)
 	}
 }
+
+// Files can be renamed and deleted from under readers, who carry on reading.
+func TestRenameAndDelete(t *testing.T) {
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "foo", []byte("hello"))
+	StoreTestFile(fs, "bar", []byte("x"))
+
+	reader, _ := fs.GetReader("foo")
+	ErrorIf(t, fs.Rename("foo", "bar") == nil, "Renaming over a file should fail")
+	ErrorIf(t, fs.Rename("missing", "baz") == nil, "Renaming a missing file should fail")
+	ErrorIf(t, fs.Rename("foo", "baz") != nil, "Rename failed")
+	ErrorIf(t, fs.Delete("baz") != nil, "Delete failed")
+	ErrorIf(t, fs.Delete("baz") == nil, "Deleting a missing file should fail")
+	ErrorIf(t, !reflect.DeepEqual(reader.ReadBlock(), []byte("hello")), "Reader should survive the delete")
+
+	files := fs.List()
+	ErrorIf(t, len(files) != 1 || files[0].Filename != "bar" || files[0].Size != 1, "Listing wrong")
+	ErrorIf(t, files[0].Created.IsZero(), "Committed files should have a creation time")
+}
@@ -0,0 +1,191 @@
+// Follow.go lets clients read a file while it's still being uploaded, so a 200 MB image can be on its way to
+// devices before the build pipeline has finished uploading it. It's opt-in: only uploads that begin with
+// LiveReads set can be followed, and only when no committed file has the name.
+// A follower is sent each block as it arrives, and waits for blocks that haven't, for up to FollowTimeout each,
+// or until its transfer is aborted. The last block, being
+// shorter than the rest, is only sent once the upload has been committed, so a follower never gets the whole
+// of a file that ends up refused. If the upload is aborted or fails, the follower gets an ERROR.
+// Only the first of several concurrent uploads of a name can be followed.
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The state of a file that can be followed while it's uploaded.
+type Growth struct {
+	Committed  bool
+	Aborted    bool
+	Arrived    *sync.Cond // Broadcast when a page is appended or the upload ends.
+	sync.Mutex            // Guards the state, and the file's pages and size until the upload ends.
+}
+
+func MakeGrowth() *Growth {
+	g := &Growth{}
+	g.Arrived = sync.NewCond(&g.Mutex)
+	return g
+}
+
+// Ends the upload, waking every follower. A nil Growth can't be followed, so there's nobody to wake.
+func (g *Growth) Finish(committed bool) {
+	if g == nil {
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	g.Committed, g.Aborted = committed, !committed
+	g.Arrived.Broadcast()
+}
+
+// Lets the file be followed while it's uploaded, if it's the only upload of its name.
+// Must be called with the lock held.
+func (f *FileSystem) follow(file *File) {
+	if f.LiveReads && f.Uploading[file.Filename] == nil {
+		file.Growth = MakeGrowth()
+		f.Uploading[file.Filename] = file
+	}
+}
+
+// Ends the upload of a followable file, committed or not. Must be called with the lock held.
+func (f *FileSystem) unfollow(file *File, committed bool) {
+	if f.Uploading[file.Filename] == file {
+		delete(f.Uploading, file.Filename)
+	}
+	file.Growth.Finish(committed)
+}
+
+// How long a follower waits for each block before giving up on the upload.
+const FollowTimeout = time.Minute
+
+// Opens a reader following the upload of the file, or returns nil if it isn't being uploaded or can't be followed.
+// Nothing is waited for until the first block is read.
+func (f *FileSystem) Follow(filename string) BlockReader {
+	f.Lock()
+	file := f.Uploading[filename]
+	f.Unlock()
+	if file == nil {
+		return nil
+	}
+
+	Log.Println("Began following upload of", filename)
+	return &FollowReader{Block: 1, Waiting: true, File: file, Timeout: FollowTimeout}
+}
+
+type FollowReader struct {
+	Block   uint16
+	Current *list.Element
+	Waiting bool // Until the current block has arrived, or the upload has ended.
+	File    *File
+	Cancel  <-chan struct{} // Closed to stop waiting, e.g. when the transfer is aborted. Nil if it can't be.
+	Timeout time.Duration   // How long to wait for each block.
+	Failure error
+}
+
+func (r *FollowReader) StopOn(cancel <-chan struct{}) {
+	r.Cancel = cancel
+}
+
+func (r *FollowReader) GetBlock() uint16 {
+	return r.Block
+}
+
+func (r *FollowReader) ReadBlock() []byte {
+	r.wait()
+	if r.Current == nil {
+		return nil
+	}
+	return r.Current.Value.([]byte)
+}
+
+// Moves on to the next block, which is waited for once it's read.
+func (r *FollowReader) AdvanceBlock() {
+	r.wait() // The next block is the one after the current block, so that has to have arrived.
+	r.Block++
+	r.Waiting = true
+}
+
+// Waits for the current block to be uploaded, or for the upload to end, the wait to be cancelled or time out.
+func (r *FollowReader) wait() {
+	if !r.Waiting || r.Failure != nil {
+		return
+	}
+	r.Waiting = false
+
+	growth := r.File.Growth
+	deadline := time.Now().Add(r.Timeout)
+	var stop chan struct{} // Closed when we're done waiting, once anything's been waited for.
+	defer func() {
+		if stop != nil {
+			close(stop)
+		}
+	}()
+
+	growth.Lock()
+	defer growth.Unlock()
+
+	for !growth.Aborted {
+		next := r.File.Pages.Front()
+		if r.Current != nil {
+			next = r.Current.Next()
+		}
+
+		if next != nil && (growth.Committed || len(next.Value.([]byte)) == FullDataPayloadLength) {
+			r.Current = next
+			return
+		}
+
+		select {
+		case <-r.Cancel:
+			r.Current = nil
+			r.Failure = fmt.Errorf("Stopped following upload of %s", r.File.Filename)
+			return
+		default:
+		}
+		if !time.Now().Before(deadline) {
+			r.Current = nil
+			r.Failure = fmt.Errorf("Timed out following upload of %s", r.File.Filename)
+			return
+		}
+
+		if stop == nil {
+			stop = make(chan struct{})
+			go r.wake(deadline, stop)
+		}
+		growth.Arrived.Wait()
+	}
+
+	r.Current = nil
+	r.Failure = fmt.Errorf("Upload of %s was aborted", r.File.Filename)
+}
+
+// Wakes the follower to give up once the wait is cancelled or times out, unless it's stopped waiting by then.
+func (r *FollowReader) wake(deadline time.Time, stop chan struct{}) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-r.Cancel:
+	case <-timer.C:
+	case <-stop:
+		return
+	}
+
+	growth := r.File.Growth
+	growth.Lock()
+	growth.Arrived.Broadcast()
+	growth.Unlock()
+}
+
+func (r *FollowReader) AtEnd() bool {
+	return len(r.ReadBlock()) < FullDataPayloadLength || r.Failure != nil
+}
+
+func (r *FollowReader) Err() error {
+	r.wait()
+	return r.Failure
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Dispatches the packet in the background, since followers wait for blocks to arrive.
+func DispatchLater(session PacketHandler, packet Packet) chan Packet {
+	reply := make(chan Packet, 1)
+	go func() {
+		reply <- Dispatch(session, packet)
+	}()
+	return reply
+}
+
+// Checks the reply hasn't been sent yet.
+func VerifyWaiting(t *testing.T, reply chan Packet) {
+	select {
+	case packet := <-reply:
+		t.Fatal("Expected the reply to wait, got", packet)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func VerifyReply(t *testing.T, reply chan Packet, expected Packet) {
+	select {
+	case packet := <-reply:
+		if !reflect.DeepEqual(packet, expected) {
+			t.Fatal("Received unexpected reply. Expected:", expected, "actual:", packet)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for", expected)
+	}
+}
+
+func TestFollowUpload(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	content := MakeTestContent(1, 2*FullDataPayloadLength+5)
+
+	// Uploads can't be followed unless asked for.
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, content[:FullDataPayloadLength]}, &AckPacket{1})
+	rs := MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+	ws.Close()
+
+	fs.LiveReads = true
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+
+	// The reader waits for the first block, then each block after it.
+	rs = MakeReadSession(fs)
+	reply := DispatchLater(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}})
+	VerifyWaiting(t, reply)
+	h.Verify(ws, &DataPacket{1, content[:FullDataPayloadLength]}, &AckPacket{1})
+	VerifyReply(t, reply, &DataPacket{1, content[:FullDataPayloadLength]})
+
+	h.Verify(ws, &DataPacket{2, content[FullDataPayloadLength : 2*FullDataPayloadLength]}, &AckPacket{2})
+	h.Verify(rs, &AckPacket{1}, &DataPacket{2, content[FullDataPayloadLength : 2*FullDataPayloadLength]})
+
+	// The last block is sent once it's committed.
+	fs.Validators = Validators{ValidatorFunc(func(file *File) *ErrorPacket {
+		VerifyWaiting(t, reply)
+		return nil
+	})}
+	reply = DispatchLater(rs, &AckPacket{2})
+	h.Verify(ws, &DataPacket{3, content[2*FullDataPayloadLength:]}, &AckPacket{3})
+	VerifyReply(t, reply, &DataPacket{3, content[2*FullDataPayloadLength:]})
+	h.Verify(rs, &AckPacket{3}, nil)
+	h.VerifyDead(rs)
+	ErrorIf(t, len(fs.Uploading) != 0, "Committed uploads shouldn't be followed any more")
+
+	// Committed files are read as usual.
+	rs = MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}}, &DataPacket{1, content[:FullDataPayloadLength]})
+	_, isFile := rs.Reader.(*FileReader)
+	ErrorIf(t, !isFile, "Committed files should be read from the store")
+}
+
+func TestFollowAbortedUpload(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.LiveReads = true
+	content := MakeTestContent(1, FullDataPayloadLength)
+
+	// Aborted uploads fail their followers.
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, content}, &AckPacket{1})
+	rs := MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}}, &DataPacket{1, content})
+	reply := DispatchLater(rs, &AckPacket{1})
+	VerifyWaiting(t, reply)
+	ws.Close()
+	VerifyReply(t, reply, &ErrorPacket{ERR_UNDEFINED, "Failed to read file"})
+	ErrorIf(t, len(fs.Uploading) != 0, "Aborted uploads shouldn't be followed any more")
+
+	// So do uploads that are refused, without sending the last block.
+	fs.Validators = Validators{ValidatorFunc(func(file *File) *ErrorPacket {
+		return &ErrorPacket{ERR_ACCESS_VIOLATION, "No"}
+	})}
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	rs = MakeReadSession(fs)
+	reply = DispatchLater(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}})
+	VerifyWaiting(t, reply)
+	h.Verify(ws, &DataPacket{1, []byte("short")}, &ErrorPacket{ERR_ACCESS_VIOLATION, "No"})
+	VerifyReply(t, reply, &ErrorPacket{ERR_UNDEFINED, "Failed to read file"})
+
+	// Only the first of concurrent uploads can be followed.
+	fs.Validators = nil
+	first, second := MakeWriteSession(fs), MakeWriteSession(fs)
+	h.Verify(first, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	h.Verify(second, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	ErrorIf(t, fs.Uploading["image"] != first.Writer || second.Writer.Growth != nil, "The first upload should be followed")
+	second.Close()
+	ErrorIf(t, fs.Uploading["image"] != first.Writer, "Closing the second upload shouldn't stop the first being followed")
+	first.Close()
+}
+
+// Followers give up on uploads that stall, and stop waiting when their transfer's aborted.
+func TestFollowGivesUp(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.LiveReads = true
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	defer ws.Close()
+
+	// Opening a follower doesn't wait; reading it does.
+	follower := fs.Follow("image").(*FollowReader)
+	follower.Timeout = 20 * time.Millisecond
+	ErrorIf(t, follower.Err() == nil || follower.ReadBlock() != nil, "Stalled uploads should time out")
+
+	cancel := make(chan struct{})
+	rs := MakeReadSession(fs)
+	rs.Cancel = cancel
+	reply := DispatchLater(rs, &ReadRequestPacket{RequestPacket{"image", "octet", nil}})
+	VerifyWaiting(t, reply)
+	close(cancel)
+	VerifyReply(t, reply, &ErrorPacket{ERR_UNDEFINED, "Failed to read file"})
+}
+
+// Connections following an upload can be described and aborted while they wait.
+func TestFollowingConnection(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.LiveReads = true
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	defer ws.Close()
+
+	client := MakeTestClient(nil)
+	transfers := MakeTransfers()
+	options := &ConnectionOptions{Host: "127.0.0.1", Timeout: time.Second, MaxRetries: 3}
+	c, err := MakeConnection(options, client.conn.LocalAddr().(*net.UDPAddr), MarshalPacket(&ReadRequestPacket{RequestPacket{"image", "octet", nil}}), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfers.Add(c)
+	go c.Listen()
+	time.Sleep(20 * time.Millisecond) // Let it start waiting for the first block.
+
+	listed := make(chan []TransferInfo, 1)
+	go func() {
+		listed <- transfers.List()
+	}()
+	select {
+	case infos := <-listed:
+		ErrorIf(t, len(infos) != 1 || infos[0].Kind != "read", "Waiting transfer described wrong")
+	case <-time.After(time.Second):
+		t.Fatal("Describing a waiting transfer shouldn't wait with it")
+	}
+
+	transfers.Abort(c.Id)
+	client.VerifyReceived(MarshalPacket(&ErrorPacket{ERR_UNDEFINED, "Failed to read file"}))
+}
+
+// Files being uploaded can always be read, even if the upload's committed while they're being opened.
+func TestFollowCommitRace(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.LiveReads = true
+
+	for i := 0; i < 200; i++ {
+		filename := fmt.Sprint("image", i)
+		ws := MakeWriteSession(fs)
+		h.Verify(ws, &WriteRequestPacket{RequestPacket{filename, "octet", nil}}, &AckPacket{0})
+
+		opened := make(chan *ErrorPacket, 10)
+		for j := 0; j < cap(opened); j++ {
+			go func() {
+				_, err := OpenStored(fs, filename)
+				opened <- err
+			}()
+		}
+		h.Verify(ws, &DataPacket{1, []byte("short")}, &AckPacket{1})
+		for j := 0; j < cap(opened); j++ {
+			if err := <-opened; err != nil {
+				t.Fatal("Reading", filename, "as its upload was committed failed:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Gateway.go serves the same files over HTTP, for firmware that boots over HTTP.
+// Requests are run through a ReadSession or WriteSession, exactly as if they'd arrived over TFTP,
+// so remapping, providers and every other rule apply the same way, and a file uploaded one way
+// can be downloaded the other way straight away.
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Gateway struct {
+	Fs       *FileSystem
+	Options  *ConnectionOptions
+	AllowPut bool
+}
+
+func MakeGateway(options *ConnectionOptions, fs *FileSystem, allowPut bool) *Gateway {
+	return &Gateway{Fs: fs, Options: options, AllowPut: allowPut}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filename := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch r.Method {
+	case "GET", "HEAD":
+		g.Get(w, r, filename)
+	case "PUT":
+		if !g.AllowPut {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		g.Put(w, r, filename)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Reads the file through a ReadSession, streaming each block to the client as it's read.
+// Range and HEAD requests need the whole file to seek within, so ServeContent serves those once it's been read.
+func (g *Gateway) Get(w http.ResponseWriter, r *http.Request, filename string) {
+	rs := MakeReadSession(g.Fs)
+	defer rs.Close()
+	rs.RemoteAddr = ParseRemoteAddr(r.RemoteAddr)
+	rs.Remap = g.Options.Remap
+	rs.Providers = g.Options.Providers
+	rs.Cancel = r.Context().Done() // Stops following an upload once the client's gone.
+
+	buffered := r.Method == "HEAD" || r.Header.Get("Range") != ""
+	streaming := false
+	var content bytes.Buffer
+	var reply Packet = &ReadRequestPacket{RequestPacket{filename, "octet", nil}}
+
+	for {
+		reply = Dispatch(rs, reply)
+
+		data, isData := reply.(*DataPacket)
+		if !isData && streaming {
+			// It's too late for an error status, so the client can only tell by the response being cut short.
+			Log.Println("Failed to stream", filename, "over HTTP:", reply)
+			panic(http.ErrAbortHandler)
+		}
+		if errPacket, isError := reply.(*ErrorPacket); isError {
+			WriteHTTPError(w, errPacket)
+			return
+		}
+		if !isData {
+			http.Error(w, "Read failed", http.StatusInternalServerError)
+			return
+		}
+
+		if buffered {
+			content.Write(data.Data)
+		} else {
+			if !streaming {
+				g.startStream(w, rs)
+				streaming = true
+			}
+			if _, err := w.Write(data.Data); err != nil {
+				return // The client's gone.
+			}
+			// Otherwise a followed upload's blocks would sit in the buffer until it's finished.
+			if _, isFollowing := rs.Reader.(*FollowReader); isFollowing {
+				if flusher, canFlush := w.(http.Flusher); canFlush {
+					flusher.Flush()
+				}
+			}
+		}
+		reply = &AckPacket{data.Block}
+
+		if len(data.Data) < FullDataPayloadLength {
+			Dispatch(rs, reply) // Let the session finish normally.
+			break
+		}
+	}
+
+	if buffered {
+		http.ServeContent(w, r, filename, time.Time{}, bytes.NewReader(content.Bytes()))
+	}
+}
+
+// Sends the headers of a streamed file. Its length is only known if it's stored, rather than generated.
+// Without a Content-Type, the first block is sniffed for one, as ServeContent would.
+func (g *Gateway) startStream(w http.ResponseWriter, rs *ReadSession) {
+	if contentType := mime.TypeByExtension(path.Ext(rs.Filename)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if fileReader, isFile := rs.Reader.(*FileReader); isFile {
+		w.Header().Set("Content-Length", strconv.Itoa(fileReader.File.Size))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Writes the body through a WriteSession.
+func (g *Gateway) Put(w http.ResponseWriter, r *http.Request, filename string) {
+	ws := MakeWriteSession(g.Fs)
+	ws.RemoteAddr = ParseRemoteAddr(r.RemoteAddr)
+	ws.Remap = g.Options.Remap
+
+	if err := Upload(ws, filename, r.Body, r.ContentLength); err != nil {
+		WriteHTTPError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Feeds a WRQ for the file and then the body, block by block, to a WriteSession.
+// The length is the body's Content-Length, or -1 if it isn't known. A body that's cut short, whether or not
+// its length is known, is discarded rather than committed.
+func Upload(ws *WriteSession, filename string, body io.Reader, length int64) *ErrorPacket {
+	defer ws.Close() // Discards the upload unless it was committed.
+
+	// The length is passed on as tsize, so uploads that won't fit are refused before they're sent.
+	var options map[string]string
+	if length >= 0 {
+		options = map[string]string{"tsize": strconv.FormatInt(length, 10)}
+	}
+	var reply Packet = &WriteRequestPacket{RequestPacket{filename, "octet", options}}
+	reply = Dispatch(ws, reply)
+	received := int64(0)
+
+	for block := uint16(1); ; block++ {
+		if errPacket, isError := reply.(*ErrorPacket); isError {
+			return errPacket
+		}
+		// Sessions only ignore blocks they already have, which we never send, so there's no going on.
+		if reply == nil {
+			return &ErrorPacket{ERR_UNDEFINED, "Upload failed"}
+		}
+		if ws.WantsToDie() {
+			return nil
+		}
+
+		chunk := make([]byte, FullDataPayloadLength)
+		bytesRead, err := readChunk(body, chunk)
+		received += int64(bytesRead)
+		if err != nil && err != io.EOF {
+			Log.Println("Failed to read upload of", filename, "due to", err)
+			return &ErrorPacket{ERR_ILLEGAL_OPERATION, "Failed to read upload"}
+		}
+		if err == io.EOF && length >= 0 && received != length {
+			return &ErrorPacket{ERR_ILLEGAL_OPERATION, "Upload was cut short"}
+		}
+
+		// Block numbers are 16 bits, so the last block has to be sent before they run out.
+		if bytesRead == FullDataPayloadLength && block == math.MaxUint16 {
+			return &ErrorPacket{ERR_DISK_FULL, "File too large"}
+		}
+
+		reply = Dispatch(ws, &DataPacket{block, chunk[:bytesRead]})
+	}
+}
+
+// Fills the chunk from the body, like io.ReadFull, except that a body ending part way through the chunk
+// gives io.EOF, so that it can be told apart from one that failed with io.ErrUnexpectedEOF.
+func readChunk(body io.Reader, chunk []byte) (int, error) {
+	bytesRead := 0
+	for bytesRead < len(chunk) {
+		n, err := body.Read(chunk[bytesRead:])
+		bytesRead += n
+		if err != nil {
+			return bytesRead, err
+		}
+	}
+	return bytesRead, nil
+}
+
+// Maps a TFTP error onto the closest HTTP status.
+func WriteHTTPError(w http.ResponseWriter, err *ErrorPacket) {
+	status := http.StatusInternalServerError
+
+	switch err.ErrorCode {
+	case ERR_FILE_NOT_FOUND:
+		status = http.StatusNotFound
+	case ERR_ACCESS_VIOLATION:
+		status = http.StatusForbidden
+	case ERR_DISK_FULL:
+		status = http.StatusInsufficientStorage
+	case ERR_FILE_ALREADY_EXISTS:
+		status = http.StatusConflict
+	case ERR_ILLEGAL_OPERATION:
+		status = http.StatusBadRequest
+	}
+
+	message := err.ErrMsg
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	http.Error(w, message, status)
+}
+
+// Sessions identify clients by UDP address, so give them one for the HTTP client.
+func ParseRemoteAddr(remoteAddr string) *net.UDPAddr {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+
+	portNumber, _ := strconv.Atoi(port)
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: portNumber}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func MakeTestGateway(t *testing.T, allowPut bool) (*FileSystem, *httptest.Server) {
+	fs := MakeFileSystem()
+	remapper, _ := ParseRemapRules(strings.NewReader("backslashes\nai ^secret"))
+	options := &ConnectionOptions{Remap: remapper}
+	return fs, httptest.NewServer(MakeGateway(options, fs, allowPut))
+}
+
+func Request(t *testing.T, method string, url string, body []byte, header http.Header) (*http.Response, []byte) {
+	request, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	content, _ := io.ReadAll(response.Body)
+	return response, content
+}
+
+// A file uploaded over TFTP can be downloaded over HTTP, and vice versa.
+func TestGatewayRoundTrip(t *testing.T) {
+	h := TestHarness{t}
+	fs, server := MakeTestGateway(t, true)
+	defer server.Close()
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"boot/tftp", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("via tftp")}, &AckPacket{1})
+
+	response, content := Request(t, "GET", server.URL+"/boot/tftp", nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusOK || string(content) != "via tftp", "GET of TFTP upload failed")
+
+	// Uploads of a multiple of 512 bytes end with an empty block, like over TFTP.
+	upload := MakeTestContent(1, 2*FullDataPayloadLength)
+	response, _ = Request(t, "PUT", server.URL+"/boot/http", upload, nil)
+	ErrorIf(t, response.StatusCode != http.StatusCreated, "PUT failed")
+
+	rs := MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"boot/http", "octet", nil}}, &DataPacket{1, upload[:FullDataPayloadLength]})
+	h.Verify(rs, &AckPacket{1}, &DataPacket{2, upload[FullDataPayloadLength:]})
+	h.Verify(rs, &AckPacket{2}, &DataPacket{3, []byte{}})
+
+	response, content = Request(t, "GET", server.URL+"/boot/http", nil, nil)
+	ErrorIf(t, !bytes.Equal(content, upload), "GET of HTTP upload failed")
+}
+
+func TestGatewayRangeAndHead(t *testing.T) {
+	fs, server := MakeTestGateway(t, false)
+	defer server.Close()
+	content := MakeTestContent(2, 3*FullDataPayloadLength+7)
+	StoreTestFile(fs, "image", content)
+
+	response, body := Request(t, "GET", server.URL+"/image", nil, http.Header{"Range": {"bytes=500-1100"}})
+	ErrorIf(t, response.StatusCode != http.StatusPartialContent, "Expected partial content")
+	ErrorIf(t, !bytes.Equal(body, content[500:1101]), "Range served wrong")
+
+	response, body = Request(t, "HEAD", server.URL+"/image", nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusOK || len(body) != 0, "HEAD failed")
+	ErrorIf(t, response.ContentLength != int64(len(content)), "HEAD should give the length")
+}
+
+// HTTP requests are subject to the same rules as TFTP requests.
+func TestGatewayRules(t *testing.T) {
+	fs, server := MakeTestGateway(t, false)
+	defer server.Close()
+	StoreTestFile(fs, "boot/pxelinux.0", []byte("pxe"))
+	StoreTestFile(fs, "secret", []byte("shh"))
+
+	response, body := Request(t, "GET", server.URL+`/boot\pxelinux.0`, nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusOK || string(body) != "pxe", "Filenames should be remapped")
+
+	response, _ = Request(t, "GET", server.URL+"/secret", nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusForbidden, "Denied files should be forbidden")
+
+	response, _ = Request(t, "GET", server.URL+"/missing", nil, nil)
+	ErrorIf(t, response.StatusCode != http.StatusNotFound, "Missing files should not be found")
+
+	response, _ = Request(t, "PUT", server.URL+"/new", []byte("x"), nil)
+	ErrorIf(t, response.StatusCode != http.StatusMethodNotAllowed, "PUT should be disabled")
+
+	fs, server = MakeTestGateway(t, true)
+	defer server.Close()
+	StoreTestFile(fs, "exists", []byte("x"))
+	response, _ = Request(t, "PUT", server.URL+"/exists", []byte("y"), nil)
+	ErrorIf(t, response.StatusCode != http.StatusConflict, "Existing files should conflict")
+}
+
+// Fails once the content has been read, like a client disconnecting part way through a body.
+type TruncatedReader struct {
+	Content io.Reader
+}
+
+func (r *TruncatedReader) Read(buffer []byte) (int, error) {
+	bytesRead, err := r.Content.Read(buffer)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return bytesRead, err
+}
+
+// Uploads that don't arrive whole, or can't be sent over TFTP, aren't committed.
+func TestGatewayUploadFailures(t *testing.T) {
+	fs := MakeFileSystem()
+	Fail := func(filename string, body io.Reader, length int64, expected *ErrorPacket) {
+		err := Upload(MakeWriteSession(fs), filename, body, length)
+		ErrorIf(t, !reflect.DeepEqual(err, expected), "Upload of "+filename+" should have failed")
+		_, exists := fs.Files[filename]
+		ErrorIf(t, exists, "Failed upload of "+filename+" shouldn't be committed")
+	}
+
+	cutShort := &ErrorPacket{ERR_ILLEGAL_OPERATION, "Failed to read upload"}
+	Fail("disconnected", &TruncatedReader{bytes.NewReader(MakeTestContent(1, 700))}, -1, cutShort)
+	Fail("short", strings.NewReader("abc"), 10, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Upload was cut short"})
+
+	// Block numbers would wrap around after 65535 blocks.
+	huge := io.LimitReader(ZeroReader{}, math.MaxUint16*FullDataPayloadLength)
+	Fail("huge", huge, -1, &ErrorPacket{ERR_DISK_FULL, "File too large"})
+	ErrorIf(t, fs.Usage.Bytes != 0, "Failed uploads should give back their space")
+
+	// Bodies that end cleanly are committed, whatever size their reads come in.
+	content := MakeTestContent(2, 3*FullDataPayloadLength+1)
+	ErrorIf(t, Upload(MakeWriteSession(fs), "whole", iotest.OneByteReader(bytes.NewReader(content)), int64(len(content))) != nil, "Upload failed")
+	ErrorIf(t, ReadTestFile(fs, "whole") != string(content), "Upload read back wrong")
+}
+
+// Reads zeroes forever.
+type ZeroReader struct{}
+
+func (ZeroReader) Read(buffer []byte) (int, error) {
+	clear(buffer)
+	return len(buffer), nil
+}
+
+// Files are streamed as they're read, so a client can download an upload while it's still arriving.
+func TestGatewayStreams(t *testing.T) {
+	h := TestHarness{t}
+	fs, server := MakeTestGateway(t, false)
+	defer server.Close()
+	fs.LiveReads = true
+	content := MakeTestContent(1, 2*FullDataPayloadLength+5)
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"image", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, content[:FullDataPayloadLength]}, &AckPacket{1})
+
+	response, err := http.Get(server.URL + "/image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	first := make([]byte, FullDataPayloadLength)
+	_, err = io.ReadFull(response.Body, first)
+	ErrorIf(t, err != nil || !bytes.Equal(first, content[:FullDataPayloadLength]), "The first block should arrive before the upload ends")
+
+	h.Verify(ws, &DataPacket{2, content[FullDataPayloadLength : 2*FullDataPayloadLength]}, &AckPacket{2})
+	h.Verify(ws, &DataPacket{3, content[2*FullDataPayloadLength:]}, &AckPacket{3})
+	rest, _ := io.ReadAll(response.Body)
+	ErrorIf(t, !bytes.Equal(append(first, rest...), content), "Streamed file read back wrong")
+
+	// Stored files are streamed with their length.
+	response, body := Request(t, "GET", server.URL+"/image", nil, nil)
+	ErrorIf(t, response.ContentLength != int64(len(content)) || !bytes.Equal(body, content), "Stored file streamed wrong")
+}
+
+// Uploads whose length won't fit are refused before they're read.
+func TestGatewayUploadTooLarge(t *testing.T) {
+	fs := MakeFileSystem()
+	fs.Quota.MaxFileBytes = 10
+	err := Upload(MakeWriteSession(fs), "big", FailingReader{}, 100)
+	ErrorIf(t, !reflect.DeepEqual(err, &ErrorPacket{ERR_DISK_FULL, "File too large"}), "Uploads too large for the quota should be refused up front")
+}
@@ -0,0 +1,222 @@
+// Gitstore.go keeps every upload in a git repository, so the configs network devices back up over TFTP have
+// a history that can be diffed and restored. Each committed upload is written to the repository's working
+// tree and committed, with the uploading client as the author and the filename and time as the message.
+// Commits are made by a hook (see hook.go) with a queue of its own, so they're made in the order files were
+// uploaded, retried if they fail, and never hold up a transfer. Those that don't fit in the queue wait in memory.
+// Files deleted from the FileSystem, whether by hand or by expiring or being evicted, are deleted from the
+// working tree too, and renamed files are moved, so it always matches the FileSystem.
+// Reads fall back to the working tree for files the FileSystem doesn't have, e.g. after a restart, and
+// name@<ref> reads the file as it was at any git revision, like core1.cfg@HEAD~3 or core1.cfg@a1b2c3d,
+// so deleted files can still be read from the revisions they were in.
+// It needs the git binary.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	GitUploadPrefix = ".upload-"                // Names the temporary files uploads are written to first.
+	GitServerAuthor = "tftpd <tftpd@localhost>" // The author of commits no client made, like deletions.
+)
+
+type GitStore struct {
+	Dir string // The working tree.
+}
+
+// Opens the repository in the directory, creating it if there isn't one.
+func OpenGitStore(dir string) (*GitStore, error) {
+	store := &GitStore{Dir: dir}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := store.git(context.Background(), "init", "--quiet"); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// Runs git in the repository, returning what it printed.
+func (s *GitStore) git(ctx context.Context, args ...string) ([]byte, error) {
+	command := exec.CommandContext(ctx, "git", args...)
+	command.Dir = s.Dir
+	// Commits shouldn't depend on how git is configured for whoever runs the server.
+	command.Env = append(os.Environ(), "GIT_COMMITTER_NAME=tftpd", "GIT_COMMITTER_EMAIL=tftpd@localhost")
+
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	output, err := command.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return output, nil
+}
+
+// Returns the path of the file in the working tree, or false if it would be outside it, in .git or an upload
+// still being written.
+func (s *GitStore) path(filename string) (string, bool) {
+	name := filepath.FromSlash(CleanMemberName(filename))
+	if !filepath.IsLocal(name) || strings.SplitN(filepath.ToSlash(name), "/", 2)[0] == ".git" ||
+		strings.HasPrefix(filepath.Base(name), GitUploadPrefix) {
+		return "", false
+	}
+	return name, true
+}
+
+// Commits uploads to the repository, and deletes and renames files in it as they are in the FileSystem.
+// Other events are ignored.
+func (s *GitStore) Run(ctx context.Context, event *HookEvent) error {
+	switch event.Event {
+	case HookCommitted:
+		return s.commitUpload(ctx, event)
+	case HookDeleted:
+		return s.commitRemoval(ctx, event)
+	case HookRenamed:
+		return s.commitRename(ctx, event)
+	}
+	return nil
+}
+
+func (s *GitStore) commitUpload(ctx context.Context, event *HookEvent) error {
+	name, ok := s.path(event.Filename)
+	if !ok {
+		Log.Println("Not committing", event.Filename, "to git, since it's outside the working tree")
+		return nil
+	}
+	if err := s.write(ctx, name, event.File); err != nil {
+		return err
+	}
+
+	client := ClientOf(event.File)
+	if client == "" {
+		client = "unknown"
+	}
+	message := fmt.Sprintf("%s uploaded at %s", event.Filename, event.Time.Format(time.RFC3339))
+	return s.commit(ctx, fmt.Sprintf("%s <tftp@%s>", client, client), message, name)
+}
+
+// Removes deleted files from the working tree, so they're only read from the revisions they were in.
+func (s *GitStore) commitRemoval(ctx context.Context, event *HookEvent) error {
+	name, ok := s.path(event.Filename)
+	if !ok {
+		return nil
+	}
+	if err := s.remove(ctx, name); err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s deleted at %s", event.Filename, event.Time.Format(time.RFC3339))
+	return s.commit(ctx, GitServerAuthor, message, name)
+}
+
+// Moves renamed files in the working tree. A file renamed from outside it is added, and one renamed to outside it
+// is removed.
+func (s *GitStore) commitRename(ctx context.Context, event *HookEvent) error {
+	var names []string
+	if from, ok := s.path(event.From); ok {
+		if err := s.remove(ctx, from); err != nil {
+			return err
+		}
+		names = append(names, from)
+	}
+	if to, ok := s.path(event.Filename); ok {
+		if err := s.write(ctx, to, event.File); err != nil {
+			return err
+		}
+		names = append(names, to)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s renamed to %s at %s", event.From, event.Filename, event.Time.Format(time.RFC3339))
+	return s.commit(ctx, GitServerAuthor, message, names...)
+}
+
+// Writes the file to the working tree and adds it to the index.
+func (s *GitStore) write(ctx context.Context, name string, file *File) error {
+	// The file is replaced in one go, so nobody reads half of it.
+	path := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), GitUploadPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Fails harmlessly once it's been renamed into place.
+	_, err = io.Copy(temp, FileContent(file))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.git(ctx, "add", "--", name)
+	return err
+}
+
+// Removes the file from the working tree and the index, if it's there.
+func (s *GitStore) remove(ctx context.Context, name string) error {
+	_, err := s.git(ctx, "rm", "--quiet", "--force", "--ignore-unmatch", "--", name)
+	return err
+}
+
+// Commits the changes to those of the files that changed, if any did.
+func (s *GitStore) commit(ctx context.Context, author string, message string, names ...string) error {
+	// Uploading the same file again, or deleting one that was never committed, changes nothing.
+	changed, err := s.git(ctx, append([]string{"diff", "--cached", "--name-only", "-z", "--"}, names...)...)
+	if err != nil || len(changed) == 0 {
+		return err
+	}
+	paths := strings.Split(strings.TrimSuffix(string(changed), "\x00"), "\x00")
+	_, err = s.git(ctx, append([]string{"commit", "--quiet", "--author", author, "-m", message, "--"}, paths...)...)
+	return err
+}
+
+func (s *GitStore) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	if name, ok := s.path(filename); ok {
+		file, err := os.Open(filepath.Join(s.Dir, name))
+		if err == nil {
+			if info, err := file.Stat(); err == nil && !info.IsDir() {
+				return &ClosingReader{Stream: file}, nil
+			}
+			file.Close()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	// Filenames can have @ in them, so revisions are only looked for once the whole name hasn't been found.
+	at := strings.LastIndex(filename, "@")
+	if at < 0 {
+		return nil, nil
+	}
+	name, ok := s.path(filename[:at])
+	ref := filename[at+1:]
+	if !ok || ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	content, err := s.git(ctx, "cat-file", "blob", ref+":"+filepath.ToSlash(name))
+	if err != nil {
+		return nil, nil // There's no such revision, or the file wasn't in it.
+	}
+	return bytes.NewReader(content), nil
+}
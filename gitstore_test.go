@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGitStore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+
+	h := TestHarness{t}
+	dir := filepath.Join(t.TempDir(), "backups")
+	store, err := OpenGitStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := MakeFileSystem()
+	fs.Versioning.Enabled = true
+	Backup := func(filename string, content string) {
+		StoreTestFile(fs, filename, []byte(content))
+		file := fs.Files[filename]
+		file.Uploader = "10.0.0.7:1234"
+		if err := store.Run(context.Background(), MakeHookEvent(HookCommitted, file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	Backup("switches/core1.cfg", "hostname core1\n")
+	Backup("switches/core1.cfg", "hostname core1\nvlan 10\n")
+	Backup("switches/core1.cfg", "hostname core1\nvlan 10\n") // Nothing changed, so nothing's committed.
+	Backup("../escape", "outside")
+	ErrorIf(t, store.Run(context.Background(), &HookEvent{Event: HookAborted, Filename: "x"}) != nil, "Other events should be ignored")
+
+	log, _ := store.git(context.Background(), "log", "--format=%an <%ae>|%s")
+	commits := strings.Split(strings.TrimSpace(string(log)), "\n")
+	ErrorIf(t, len(commits) != 2, "Expected 2 commits, got "+string(log))
+	ErrorIf(t, !strings.HasPrefix(commits[0], "10.0.0.7 <tftp@10.0.0.7>|switches/core1.cfg uploaded at "), "Wrong commit "+commits[0])
+	_, err = os.Stat(filepath.Join(dir, "..", "escape"))
+	ErrorIf(t, err == nil, "Files outside the working tree shouldn't be written")
+
+	// Files the FileSystem doesn't have are read from the working tree, or from any revision.
+	providers := MakeContentProviders()
+	providers.AddFallback(store)
+	Read := func(filename string, expected Packet) {
+		rs := MakeReadSession(MakeFileSystem())
+		rs.Providers = providers
+		h.Verify(rs, &ReadRequestPacket{RequestPacket{filename, "octet", nil}}, expected)
+	}
+	NotFound := &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
+
+	Read("switches/core1.cfg", &DataPacket{1, []byte("hostname core1\nvlan 10\n")})
+	Read("switches/core1.cfg@HEAD~1", &DataPacket{1, []byte("hostname core1\n")})
+	Read("switches/core1.cfg@HEAD", &DataPacket{1, []byte("hostname core1\nvlan 10\n")})
+	Read("switches/core1.cfg@nonsense", NotFound)
+	Read("switches/core1.cfg@--output=x", NotFound)
+	Read("switches", NotFound)
+	Read(".git/config", NotFound)
+	Read("missing.cfg", NotFound)
+
+	// Reopening the repository keeps its history.
+	store, err = OpenGitStore(dir)
+	ErrorIf(t, err != nil || store.Dir != dir, "Reopening the repository should work")
+	log, _ = store.git(context.Background(), "log", "--oneline")
+	ErrorIf(t, strings.Count(string(log), "\n") != 2, "Reopening the repository shouldn't lose commits")
+
+	// Deleted, expired and renamed files are deleted or moved in the working tree too, but stay in its history.
+	fs.Backups = MakeHooks(10)
+	Sync := func() {
+		for len(fs.Backups.Queue) > 0 {
+			if err := store.Run(context.Background(), <-fs.Backups.Queue); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ErrorIf(t, fs.Rename("switches/core1.cfg", "switches/core2.cfg") != nil, "Renaming should work")
+	Sync()
+	Read("switches/core1.cfg", NotFound)
+	Read("switches/core2.cfg", &DataPacket{1, []byte("hostname core1\nvlan 10\n")})
+	Read("switches/core1.cfg@HEAD~1", &DataPacket{1, []byte("hostname core1\nvlan 10\n")})
+
+	ErrorIf(t, fs.Delete("switches/core2.cfg") != nil, "Deleting should work")
+	StoreTestFile(fs, "expiring.cfg", []byte("soon gone"))
+	fs.Files["expiring.cfg"].Expires = time.Now()
+	fs.Expire(time.Now())
+	Sync()
+	Read("switches/core2.cfg", NotFound)
+	Read("switches/core2.cfg@HEAD~3", &DataPacket{1, []byte("hostname core1\nvlan 10\n")})
+	Read("expiring.cfg", NotFound)
+	Read("expiring.cfg@HEAD~1", &DataPacket{1, []byte("soon gone")})
+
+	log, _ = store.git(context.Background(), "log", "--format=%an|%s", "-4")
+	commits = strings.Split(strings.TrimSpace(string(log)), "\n")
+	ErrorIf(t, len(commits) != 4 || !strings.HasPrefix(commits[3], "tftpd|switches/core1.cfg renamed to switches/core2.cfg at ") ||
+		!strings.HasPrefix(commits[2], "tftpd|switches/core2.cfg deleted at "), "Wrong commits "+string(log))
+
+	// Deleting files that were never committed changes nothing.
+	ErrorIf(t, store.Run(context.Background(), &HookEvent{Event: HookDeleted, Filename: "never.cfg"}) != nil, "Deleting a file git doesn't have should do nothing")
+	log, _ = store.git(context.Background(), "log", "--oneline")
+	ErrorIf(t, strings.Count(string(log), "\n") != 6, "Deleting a file git doesn't have shouldn't commit")
+
+	// Uploads still being written aren't read.
+	os.WriteFile(filepath.Join(dir, GitUploadPrefix+"123"), []byte("half"), 0644)
+	Read(GitUploadPrefix+"123", NotFound)
+}
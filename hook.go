@@ -0,0 +1,284 @@
+// Hook.go tells other programs about uploads, so they can act on them, like diffing a switch's config and alerting.
+// An event is raised when an upload is committed, when it fails (e.g. for being over quota or a checksum mismatch),
+// and when it's aborted before its last block. Each event is passed to every hook, which is either:
+//   A command, run with "--", the event and the filename as its arguments (so filenames starting with "-" can't
+//   pass as options), the details in TFTP_* environment variables
+//   and, for committed uploads, the file on its standard input.
+//   A webhook: an HTTP URL the event is POSTed to as JSON.
+// Hooks run in the background, one event at a time and in the order the events were raised, so a slow hook never
+// holds up a transfer. Each attempt to run a hook has a timeout, and failed attempts are retried with a growing delay.
+// Events are queued up to a limit; beyond it they're dropped and logged, rather than piling up in memory,
+// unless the hooks are Lossless, like the git store's, in which case they wait in memory for room in the queue.
+// Lossless hooks only need each file's latest state, so an upload or deletion waiting there replaces any waiting
+// before it for the same file, and if that's still too many events to keep, they're dropped and logged after all.
+// Backups (see file.go) are also told when files are deleted, expired, evicted or renamed, so they can follow suit.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HookCommitted = "committed"
+	HookFailed    = "failed"
+	HookAborted   = "aborted"
+	// Only backups are told about these, since they aren't about uploads.
+	HookDeleted = "deleted"
+	HookRenamed = "renamed"
+)
+
+type HookEvent struct {
+	Event     string            `json:"event"` // HookCommitted, HookFailed, HookAborted, HookDeleted or HookRenamed.
+	Filename  string            `json:"filename"`
+	From      string            `json:"from,omitempty"` // The old name of a renamed file.
+	Size      int               `json:"size"`           // How much had been uploaded, for uploads that weren't committed.
+	Uploader  string            `json:"uploader"`
+	Version   int               `json:"version,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Error     string            `json:"error,omitempty"` // Why the upload failed.
+	Time      time.Time         `json:"time"`
+	File      *File             `json:"-"` // The committed or renamed file; nil otherwise.
+}
+
+func MakeHookEvent(event string, file *File) *HookEvent {
+	hookEvent := &HookEvent{
+		Event:    event,
+		Filename: file.Filename,
+		Size:     file.Size,
+		Uploader: file.Uploader,
+		Time:     time.Now(),
+	}
+	if event == HookCommitted || event == HookRenamed {
+		hookEvent.Version = file.Version
+		hookEvent.Checksums = file.Checksums
+		hookEvent.File = file
+	}
+	return hookEvent
+}
+
+type Hook interface {
+	// Returns an error if the hook failed, so it's retried.
+	Run(ctx context.Context, event *HookEvent) error
+}
+
+// Lets ordinary functions be used as Hooks.
+type HookFunc func(ctx context.Context, event *HookEvent) error
+
+func (f HookFunc) Run(ctx context.Context, event *HookEvent) error {
+	return f(ctx, event)
+}
+
+type Hooks struct {
+	Hooks      []Hook
+	Timeout    time.Duration // How long each attempt to run a hook may take.
+	Retries    int           // How many times to retry a hook that failed.
+	RetryDelay time.Duration // How long to wait before the first retry. It doubles for each one after.
+	Queue      chan *HookEvent
+	Lossless   bool         // Whether events that don't fit in the Queue wait in the Backlog, rather than being dropped.
+	Backlog    []*HookEvent // Events waiting for room in the Queue, newer than every event in it.
+	MaxBacklog int          // How many events may wait in the Backlog before more are dropped after all.
+	sync.Mutex              // Guards the Backlog, and the order events are queued in.
+}
+
+// How many events lossless hooks keep waiting by default.
+const HookMaxBacklog = 100000
+
+// Makes hooks with room to queue queueLength events. Nothing runs until Run is called.
+func MakeHooks(queueLength int, hooks ...Hook) *Hooks {
+	return &Hooks{
+		Hooks:      hooks,
+		Timeout:    30 * time.Second,
+		Retries:    3,
+		RetryDelay: time.Second,
+		Queue:      make(chan *HookEvent, queueLength),
+		MaxBacklog: HookMaxBacklog,
+	}
+}
+
+// Queues the event for the hooks, without waiting. Nil Hooks ignore every event.
+func (h *Hooks) Notify(event *HookEvent) {
+	if h == nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	// Events can only skip the backlog if there isn't one, or they'd be run out of order.
+	if len(h.Backlog) == 0 {
+		select {
+		case h.Queue <- event:
+			return
+		default:
+		}
+	}
+
+	if !h.Lossless {
+		Log.Println("Dropped", event.Event, "event for", event.Filename, "since the hook queue is full")
+		return
+	}
+	h.supersede(event)
+	if len(h.Backlog) >= h.MaxBacklog {
+		Log.Println("Dropped", event.Event, "event for", event.Filename, "since", len(h.Backlog), "events are already waiting in memory")
+		return
+	}
+	if len(h.Backlog) == 0 {
+		Log.Println("The hook queue is full, so", event.Event, "event for", event.Filename, "is waiting in memory")
+	}
+	h.Backlog = append(h.Backlog, event)
+}
+
+// Runs the hooks for each event as it's queued, forever.
+func (h *Hooks) Run() {
+	for event := range h.Queue {
+		h.refill()
+		for _, hook := range h.Hooks {
+			h.runHook(hook, event)
+		}
+	}
+}
+
+// Drops the events waiting in the backlog that the new event makes pointless: uploads and deletions of the same file.
+// Renames are kept, since the file they were renamed from still has to go. Must be called with the lock held.
+func (h *Hooks) supersede(event *HookEvent) {
+	if event.Event != HookCommitted && event.Event != HookDeleted {
+		return
+	}
+
+	kept := h.Backlog[:0]
+	for _, waiting := range h.Backlog {
+		if waiting.Filename != event.Filename || (waiting.Event != HookCommitted && waiting.Event != HookDeleted) {
+			kept = append(kept, waiting)
+		}
+	}
+	clear(h.Backlog[len(kept):]) // So the files can be freed.
+	h.Backlog = kept
+}
+
+// Moves events waiting in the backlog into the queue, as far as there's room.
+func (h *Hooks) refill() {
+	h.Lock()
+	defer h.Unlock()
+
+	for len(h.Backlog) > 0 {
+		select {
+		case h.Queue <- h.Backlog[0]:
+			h.Backlog[0] = nil // So the file can be freed once its event has run.
+			h.Backlog = h.Backlog[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (h *Hooks) runHook(hook Hook, event *HookEvent) {
+	delay := h.RetryDelay
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+		err := hook.Run(ctx, event)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		if attempt == h.Retries {
+			Log.Println("Gave up on hook for", event.Event, "event for", event.Filename, "due to", err)
+			return
+		}
+		Log.Println("Retrying hook for", event.Event, "event for", event.Filename, "due to", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Makes hooks given like "/usr/local/bin/diff-config,https://alerts.example.com/tftp".
+// URLs are webhooks, and anything else is a command.
+func ParseHooks(spec string) []Hook {
+	var hooks []Hook
+	for _, target := range strings.Split(spec, ",") {
+		if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+			hooks = append(hooks, &WebhookHook{URL: target, Client: http.DefaultClient})
+		} else {
+			hooks = append(hooks, &CommandHook{Path: target})
+		}
+	}
+	return hooks
+}
+
+type CommandHook struct {
+	Path string
+}
+
+func (c *CommandHook) Run(ctx context.Context, event *HookEvent) error {
+	command := exec.CommandContext(ctx, c.Path, "--", event.Event, event.Filename)
+	command.Env = append(os.Environ(),
+		"TFTP_EVENT="+event.Event,
+		"TFTP_FILENAME="+event.Filename,
+		"TFTP_SIZE="+strconv.Itoa(event.Size),
+		"TFTP_UPLOADER="+event.Uploader,
+		"TFTP_VERSION="+strconv.Itoa(event.Version),
+		"TFTP_ERROR="+event.Error,
+	)
+	for algorithm, sum := range event.Checksums {
+		command.Env = append(command.Env, "TFTP_"+strings.ToUpper(algorithm)+"="+sum)
+	}
+	if event.File != nil {
+		command.Stdin = FileContent(event.File)
+	}
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", c.Path, err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// Reads a committed file from start to end.
+func FileContent(file *File) io.Reader {
+	var pages []io.Reader
+	for page := file.Pages.Front(); page != nil; page = page.Next() {
+		pages = append(pages, bytes.NewReader(page.Value.([]byte)))
+	}
+	return io.MultiReader(pages...)
+}
+
+type WebhookHook struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *WebhookHook) Run(ctx context.Context, event *HookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s replied %s", w.URL, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hooks that record the events they're given, without running them.
+func MakeTestHooks(fs *FileSystem) chan *HookEvent {
+	fs.Hooks = MakeHooks(10)
+	return fs.Hooks.Queue
+}
+
+func TestHookEvents(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Quota.MaxFileBytes = FullDataPayloadLength
+	events := MakeTestHooks(fs)
+	fs.Backups = MakeHooks(10)
+
+	ws := MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"switch.cfg", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("hostname core1")}, &AckPacket{1})
+	ws.Close()
+	event := <-events
+	ErrorIf(t, event.Event != HookCommitted || event.Filename != "switch.cfg" || event.Size != 14, "Expected a committed event")
+	ErrorIf(t, event.Version != 1 || event.Checksums["sha256"] == "" || event.File == nil, "Committed events should describe the file")
+
+	fs.Integrity.Expected = map[string]string{"fw.bin": "00"}
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"fw.bin", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("firmware")}, &ErrorPacket{ERR_UNDEFINED, "Checksum mismatch"})
+	ws.Close()
+	event = <-events
+	ErrorIf(t, event.Event != HookFailed || event.Error == "" || event.File != nil, "Expected a failed event")
+
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"big", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(1, FullDataPayloadLength)}, &AckPacket{1})
+	h.Verify(ws, &DataPacket{2, []byte("too much")}, &ErrorPacket{ERR_DISK_FULL, "File too large"})
+	event = <-events
+	ErrorIf(t, event.Event != HookFailed || event.Size != FullDataPayloadLength, "Expected a failed event for the upload so far")
+
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"partial", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(1, FullDataPayloadLength)}, &AckPacket{1})
+	ws.Close()
+	ws.Close()
+	event = <-events
+	ErrorIf(t, event.Event != HookAborted || event.Filename != "partial", "Expected an aborted event")
+	ErrorIf(t, len(events) != 0, "Each upload should raise one event")
+	ErrorIf(t, len(fs.Backups.Queue) != 1 || (<-fs.Backups.Queue).Filename != "switch.cfg", "Backups should only be told about committed uploads")
+
+	// Refused requests never became uploads.
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"switch.cfg", "octet", nil}}, &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""})
+	ws.Close()
+	ErrorIf(t, len(events) != 0, "Refused requests shouldn't raise events")
+}
+
+func TestHookRetriesAndQueue(t *testing.T) {
+	attempts := make(chan int, 10)
+	count := 0
+	hooks := MakeHooks(1, HookFunc(func(ctx context.Context, event *HookEvent) error {
+		count++
+		attempts <- count
+		<-ctx.Done() // Every attempt times out.
+		return ctx.Err()
+	}))
+	hooks.Timeout = time.Millisecond
+	hooks.Retries = 2
+	hooks.RetryDelay = time.Millisecond
+
+	// The queue holds one event, so a second is dropped rather than waiting.
+	hooks.Notify(&HookEvent{Event: HookCommitted, Filename: "a"})
+	hooks.Notify(&HookEvent{Event: HookCommitted, Filename: "b"})
+	go hooks.Run()
+
+	for expected := 1; expected <= 3; expected++ {
+		ErrorIf(t, <-attempts != expected, "Wrong attempt")
+	}
+	select {
+	case <-attempts:
+		t.Error("Hooks should be retried only so many times")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Lossless hooks keep the events that don't fit, and run them in order.
+	ran := make(chan string, 10)
+	lossless := MakeHooks(1, HookFunc(func(ctx context.Context, event *HookEvent) error {
+		ran <- event.Filename
+		return nil
+	}))
+	lossless.Lossless = true
+	for _, filename := range []string{"a", "b", "c"} {
+		lossless.Notify(&HookEvent{Event: HookCommitted, Filename: filename})
+	}
+	ErrorIf(t, len(lossless.Backlog) != 2, "Events that don't fit should wait")
+	go lossless.Run()
+	for _, expected := range []string{"a", "b", "c"} {
+		ErrorIf(t, <-ran != expected, "Lossless hooks should run every event in order")
+	}
+
+	// Only the latest upload or deletion of each file waits, and only so many events do.
+	ran = make(chan string, 10)
+	lossless = MakeHooks(1, HookFunc(func(ctx context.Context, event *HookEvent) error {
+		ran <- event.Event + " " + event.Filename
+		return nil
+	}))
+	lossless.Lossless = true
+	lossless.MaxBacklog = 3
+	lossless.Notify(&HookEvent{Event: HookCommitted, Filename: "a"})
+	lossless.Notify(&HookEvent{Event: HookCommitted, Filename: "b"})
+	lossless.Notify(&HookEvent{Event: HookRenamed, Filename: "c", From: "b"})
+	lossless.Notify(&HookEvent{Event: HookCommitted, Filename: "b"})
+	lossless.Notify(&HookEvent{Event: HookDeleted, Filename: "b"})
+	lossless.Notify(&HookEvent{Event: HookCommitted, Filename: "d"})
+	lossless.Notify(&HookEvent{Event: HookCommitted, Filename: "e"})
+	ErrorIf(t, len(lossless.Backlog) != 3, "The backlog should be capped")
+	go lossless.Run()
+	for _, expected := range []string{"committed a", "renamed c", "deleted b", "committed d"} {
+		ErrorIf(t, <-ran != expected, "Superseded events shouldn't be run, nor those past the cap")
+	}
+	select {
+	case event := <-ran:
+		t.Error("Events past the cap should be dropped, but ran", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var nilHooks *Hooks
+	nilHooks.Notify(&HookEvent{}) // Doesn't panic.
+}
+
+func TestCommandHook(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	out := filepath.Join(dir, "out")
+	os.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $2 $3 $TFTP_SIZE $TFTP_UPLOADER $TFTP_SHA256\" > "+out+"\ncat >> "+out+"\n"), 0755)
+
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "switch.cfg", []byte("hostname core1"))
+	file := fs.Files["switch.cfg"]
+	file.Uploader = "10.0.0.7:1234"
+
+	hook := &CommandHook{Path: script}
+	if err := hook.Run(context.Background(), MakeHookEvent(HookCommitted, file)); err != nil {
+		t.Fatal(err)
+	}
+	output, _ := os.ReadFile(out)
+	expected := fmt.Sprintf("-- committed switch.cfg 14 10.0.0.7:1234 %s\nhostname core1", file.Checksums["sha256"])
+	ErrorIf(t, string(output) != expected, "Wrong command output: "+string(output))
+
+	failing := &CommandHook{Path: filepath.Join(dir, "missing")}
+	ErrorIf(t, failing.Run(context.Background(), MakeHookEvent(HookCommitted, file)) == nil, "Missing commands should fail")
+}
+
+func TestWebhook(t *testing.T) {
+	var received HookEvent
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	hooks := ParseHooks(server.URL + ",/usr/local/bin/diff-config")
+	_, isCommand := hooks[1].(*CommandHook)
+	ErrorIf(t, len(hooks) != 2 || !isCommand, "Paths should be commands")
+
+	event := &HookEvent{Event: HookFailed, Filename: "switch.cfg", Size: 3, Error: "TFTP error 3: File too large"}
+	ErrorIf(t, hooks[0].Run(context.Background(), event) != nil, "Webhook should succeed")
+	ErrorIf(t, received.Event != HookFailed || received.Filename != "switch.cfg" || !strings.Contains(received.Error, "too large"),
+		"Webhook should get the event as JSON")
+
+	status = http.StatusBadGateway
+	ErrorIf(t, hooks[0].Run(context.Background(), event) == nil, "Webhooks that reply with errors should fail")
+}
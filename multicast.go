@@ -0,0 +1,371 @@
+// Multicast.go implements the multicast option (RFC 2090), so that many clients reading the same file
+// at once (e.g. a rack of machines PXE booting) share one stream of DATA packets.
+// Each file being multicast has a MulticastGroup with its own port, which every member of the group talks to.
+// The first member is the master client: it ACKs on behalf of the group, and DATA goes to the group address.
+// Members that joined late ACK the blocks they missed once they become the master.
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maximum number of files that can be multicast at once. Each group gets its own port.
+const MaxMulticastGroups = 64
+
+// Tracks the multicast groups, one per file being multicast.
+type MulticastGroups struct {
+	Addr     net.IP // Multicast address DATA is sent to.
+	BasePort int    // Groups use ports BasePort to BasePort+MaxMulticastGroups-1.
+	Groups   map[string]*MulticastGroup
+	sync.Mutex
+}
+
+func MakeMulticastGroups(addr net.IP, basePort int) *MulticastGroups {
+	return &MulticastGroups{
+		Addr:     addr,
+		BasePort: basePort,
+		Groups:   make(map[string]*MulticastGroup),
+	}
+}
+
+// A file being multicast, and the clients receiving it.
+type MulticastGroup struct {
+	Filename        string
+	Conn            *net.UDPConn // Our side of every member's connection.
+	GroupAddr       *net.UDPAddr
+	Reader          *FileReader
+	Members         []*net.UDPAddr // In the order they joined. The first is the master client.
+	LastReplyPacket []byte
+	LastReplyAddr   *net.UDPAddr
+	MaxRetries      int
+	Timeout         time.Duration
+	Closed          bool
+	sync.Mutex      // Guards Members, the last reply and Closed, since members join from the listener's goroutine.
+}
+
+// Adds the sender of a packet to the multicast group for the file it requests, creating the group if need be.
+// Returns false if the packet isn't an RRQ with the multicast option, or the file can't be multicast,
+// in which case it should be handled by a regular Connection. (Ignoring the option is how we decline it.)
+func (m *MulticastGroups) TryJoin(options *ConnectionOptions, raddr *net.UDPAddr, data []byte, fs *FileSystem) bool {
+	packet, err := UnmarshalPacket(data)
+	if err != nil {
+		return false
+	}
+
+	request, isRead := packet.(*ReadRequestPacket)
+	if !isRead {
+		return false
+	}
+	if _, wantsMulticast := request.Options["multicast"]; !wantsMulticast {
+		return false
+	}
+
+	// Denied requests are left for the Connection to turn away.
+	filename, err := options.Remap.Remap(request.Filename, PKT_RRQ, raddr.IP)
+	if err != nil {
+		return false
+	}
+
+	// Only files a ReadSession would read from the store can be multicast, since the group seeks within them.
+	// Files a provider generates for the client are left for a regular Connection.
+	if options.Providers.Overrides(filename, raddr) {
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	group := m.Groups[filename]
+	if group != nil && group.AddMember(raddr) {
+		return true
+	}
+
+	group, err = m.makeGroup(options, filename, fs)
+	if err != nil {
+		Log.Println("Declining multicast of", filename, "due to", err)
+		return false
+	}
+	m.Groups[filename] = group
+	group.AddMember(raddr)
+
+	go func() {
+		group.Listen()
+		m.remove(group)
+	}()
+
+	return true
+}
+
+// Must be called with the lock held.
+func (m *MulticastGroups) makeGroup(options *ConnectionOptions, filename string, fs *FileSystem) (*MulticastGroup, error) {
+	reader, errPacket := fs.GetReader(filename)
+	if errPacket != nil {
+		return nil, fmt.Errorf("File not found")
+	}
+
+	port, err := m.freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	laddr := net.UDPAddr{
+		Port: 0, // The OS will give us a random port from the ephemeral pool.
+		IP:   net.ParseIP(options.Host),
+	}
+	conn, err := net.ListenUDP("udp", &laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MulticastGroup{
+		Filename:   filename,
+		Conn:       conn,
+		GroupAddr:  &net.UDPAddr{IP: m.Addr, Port: port},
+		Reader:     reader,
+		MaxRetries: options.MaxRetries,
+		Timeout:    options.Timeout,
+	}, nil
+}
+
+// Must be called with the lock held.
+func (m *MulticastGroups) freePort() (int, error) {
+	used := make(map[int]bool)
+	for _, group := range m.Groups {
+		used[group.GroupAddr.Port] = true
+	}
+
+	for port := m.BasePort; port < m.BasePort+MaxMulticastGroups; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Too many multicast groups")
+}
+
+func (m *MulticastGroups) remove(group *MulticastGroup) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Groups[group.Filename] == group {
+		delete(m.Groups, group.Filename)
+	}
+}
+
+// Adds a member to the group, and tells it where the group is.
+// If it's already a member, its RRQ was re-sent because our OACK was lost, so we send another.
+// Returns false if the group has already finished.
+func (g *MulticastGroup) AddMember(addr *net.UDPAddr) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.Closed {
+		return false
+	}
+
+	if g.memberIndex(addr) < 0 {
+		g.Members = append(g.Members, addr)
+		Log.Println(addr, "joined multicast group for", g.Filename)
+	}
+
+	oack := g.makeOptionAck(addr)
+	if g.memberIndex(addr) == 0 {
+		// The master's OACK is re-sent until it ACKs.
+		g.LastReplyPacket = oack
+		g.LastReplyAddr = addr
+	}
+	g.send(oack, addr)
+
+	return true
+}
+
+// Serves the group until every member has the file, has left, or has stopped responding.
+func (g *MulticastGroup) Listen() {
+	defer g.Conn.Close()
+
+	retries := 0
+	buffer := make([]byte, MaxPacketSize)
+	g.Conn.SetReadDeadline(time.Now().Add(g.Timeout))
+
+	for {
+		bytesRead, clientAddr, err := g.Conn.ReadFromUDP(buffer)
+		if err != nil {
+			opError, isOpError := err.(*net.OpError)
+			if !isOpError || !opError.Timeout() {
+				Log.Println("Error: ", err)
+				g.close()
+				return
+			}
+
+			// We timed out, so re-send to the master. If it's gone quiet, give up on it.
+			retries++
+			if retries > g.MaxRetries {
+				retries = 0
+				if !g.dropMaster() {
+					return
+				}
+			} else {
+				g.resend()
+			}
+			g.Conn.SetReadDeadline(time.Now().Add(g.Timeout))
+			continue
+		}
+
+		packet, err := UnmarshalPacket(buffer[:bytesRead])
+		if err != nil {
+			continue
+		}
+
+		if g.ProcessPacket(clientAddr, packet) {
+			// The master made progress, so it gets a fresh set of retries.
+			retries = 0
+			g.Conn.SetReadDeadline(time.Now().Add(g.Timeout))
+		}
+
+		if !g.HasMembers() {
+			return
+		}
+	}
+}
+
+// Handles a packet from a member. Returns true if we replied to it.
+// Like a ReadSession, duplicate ACKs are ignored rather than answered, so the Sorcerer's Apprentice
+// syndrome can't start; unlike a ReadSession, the master may ACK any block, to skip over the blocks
+// it already heard before it became master.
+func (g *MulticastGroup) ProcessPacket(addr *net.UDPAddr, packet Packet) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	index := g.memberIndex(addr)
+	if index < 0 {
+		return false
+	}
+
+	switch p := packet.(type) {
+	case *ErrorPacket:
+		// The member is leaving.
+		Log.Println(addr, "left multicast group for", g.Filename)
+		g.removeMember(index)
+		if index == 0 {
+			return g.promoteMaster()
+		}
+		return false
+	case *AckPacket:
+		// Only the master's ACKs count.
+		if index != 0 {
+			return false
+		}
+
+		// Ignore ACKs for blocks before the one we last sent; those are duplicates.
+		if g.LastReplyAddr == g.GroupAddr && p.Block < g.Reader.Block {
+			return false
+		}
+
+		numBlocks := g.Reader.File.GetNumBlocks()
+		if p.Block >= numBlocks {
+			// The master has the whole file.
+			Log.Println(addr, "finished reading", g.Filename, "by multicast")
+			g.removeMember(0)
+			return g.promoteMaster()
+		}
+
+		g.Reader.Seek(p.Block + 1)
+		g.LastReplyPacket = MarshalPacket(&DataPacket{g.Reader.Block, g.Reader.ReadBlock()})
+		g.LastReplyAddr = g.GroupAddr
+		g.send(g.LastReplyPacket, g.LastReplyAddr)
+		return true
+	default:
+		return false
+	}
+}
+
+func (g *MulticastGroup) HasMembers() bool {
+	g.Lock()
+	defer g.Unlock()
+
+	return len(g.Members) > 0
+}
+
+// Gives up on an unresponsive master and makes the next member the master.
+// Returns false if there's nobody left.
+func (g *MulticastGroup) dropMaster() bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if len(g.Members) > 0 {
+		Log.Println("Gave up on multicast master", g.Members[0], "for", g.Filename)
+		g.removeMember(0)
+	}
+	g.promoteMaster()
+
+	return !g.Closed
+}
+
+func (g *MulticastGroup) resend() {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.LastReplyPacket != nil {
+		g.send(g.LastReplyPacket, g.LastReplyAddr)
+	}
+}
+
+func (g *MulticastGroup) close() {
+	g.Lock()
+	defer g.Unlock()
+
+	g.Closed = true
+}
+
+// Tells the first member it's the master, so that it ACKs the blocks it's missing.
+// If there are no members left, the group is closed. Must be called with the lock held.
+func (g *MulticastGroup) promoteMaster() bool {
+	if len(g.Members) == 0 {
+		g.Closed = true
+		g.LastReplyPacket = nil
+		return false
+	}
+
+	master := g.Members[0]
+	g.LastReplyPacket = g.makeOptionAck(master)
+	g.LastReplyAddr = master
+	g.send(g.LastReplyPacket, master)
+	return true
+}
+
+// Must be called with the lock held.
+func (g *MulticastGroup) makeOptionAck(addr *net.UDPAddr) []byte {
+	isMaster := "0"
+	if g.memberIndex(addr) == 0 {
+		isMaster = "1"
+	}
+
+	value := g.GroupAddr.IP.String() + "," + strconv.Itoa(g.GroupAddr.Port) + "," + isMaster
+	return MarshalPacket(&OptionAckPacket{map[string]string{"multicast": value}})
+}
+
+// Must be called with the lock held.
+func (g *MulticastGroup) memberIndex(addr *net.UDPAddr) int {
+	for index, member := range g.Members {
+		if member.IP.Equal(addr.IP) && member.Port == addr.Port {
+			return index
+		}
+	}
+	return -1
+}
+
+// Must be called with the lock held.
+func (g *MulticastGroup) removeMember(index int) {
+	g.Members = append(g.Members[:index], g.Members[index+1:]...)
+}
+
+func (g *MulticastGroup) send(data []byte, addr *net.UDPAddr) {
+	_, err := g.Conn.WriteToUDP(data, addr)
+	if err != nil {
+		Log.Println("Writing packet failed due to", err)
+	}
+}
@@ -0,0 +1,225 @@
+// The multicast groups are tested with real UDP, like the connection layer. Instead of a multicast address,
+// the group address is a unicast socket owned by the test, which stands in for everybody listening to the group.
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type MulticastTestHarness struct {
+	t       *testing.T
+	fs      *FileSystem
+	groups  *MulticastGroups
+	group   *net.UDPConn // Hears everything sent to the group.
+	options ConnectionOptions
+}
+
+func MakeMulticastTestHarness(t *testing.T) *MulticastTestHarness {
+	group, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "foo", MakeTestContent(1, 2*FullDataPayloadLength+10))
+
+	return &MulticastTestHarness{
+		t:      t,
+		fs:     fs,
+		groups: MakeMulticastGroups(net.ParseIP("127.0.0.1"), group.LocalAddr().(*net.UDPAddr).Port),
+		group:  group,
+		options: ConnectionOptions{
+			Host:       "127.0.0.1",
+			Timeout:    100 * time.Millisecond,
+			MaxRetries: 2,
+		},
+	}
+}
+
+// Joins a new client to the group for foo, returning its TestClient.
+func (h *MulticastTestHarness) Join() *TestClient {
+	client := MakeTestClient(nil)
+	request := MarshalPacket(&ReadRequestPacket{RequestPacket{"foo", "octet", map[string]string{"multicast": ""}}})
+	if !h.groups.TryJoin(&h.options, client.conn.LocalAddr().(*net.UDPAddr), request, h.fs) {
+		h.t.Fatal("Failed to join multicast group")
+	}
+	return client
+}
+
+func (h *MulticastTestHarness) VerifyOptionAck(client *TestClient, isMaster string) {
+	groupPort := h.group.LocalAddr().(*net.UDPAddr).Port
+	expected := &OptionAckPacket{map[string]string{"multicast": "127.0.0.1," + strconv.Itoa(groupPort) + "," + isMaster}}
+	client.sessionAddr = nil // Make sure the OACK comes from the group's port, like every other member's.
+
+	reply, err := client.AwaitReceive()
+	if err != nil {
+		h.t.Fatal("Expected OACK:", err)
+	}
+	packet, _ := UnmarshalPacket(reply)
+	if !reflect.DeepEqual(expected, packet) {
+		h.t.Fatal("Expected", expected, "got", packet)
+	}
+}
+
+// Verifies the next thing sent to the group is the given block of foo.
+func (h *MulticastTestHarness) VerifyGroupData(block uint16) {
+	buf := make([]byte, MaxPacketSize)
+	h.group.SetReadDeadline(time.Now().Add(time.Second))
+	bytesRead, _, err := h.group.ReadFromUDP(buf)
+	if err != nil {
+		h.t.Fatal("Expected DATA", block, "to be sent to the group:", err)
+	}
+
+	packet, _ := UnmarshalPacket(buf[:bytesRead])
+	data, isData := packet.(*DataPacket)
+	if !isData || data.Block != block {
+		h.t.Fatal("Expected DATA", block, "to be sent to the group, got", packet)
+	}
+}
+
+func (h *MulticastTestHarness) VerifyGroupQuiet(duration time.Duration) {
+	buf := make([]byte, MaxPacketSize)
+	h.group.SetReadDeadline(time.Now().Add(duration))
+	_, _, err := h.group.ReadFromUDP(buf)
+	if err == nil {
+		h.t.Fatal("Nothing should have been sent to the group")
+	}
+}
+
+func (h *MulticastTestHarness) VerifyClosed() {
+	// The group is removed from the registry by its goroutine, so give it a moment.
+	time.Sleep(10 * time.Millisecond)
+	h.groups.Lock()
+	defer h.groups.Unlock()
+	if len(h.groups.Groups) != 0 {
+		h.t.Fatal("Group should have closed")
+	}
+}
+
+func Ack(block uint16) []byte {
+	return MarshalPacket(&AckPacket{block})
+}
+
+func TestMulticastSingleClient(t *testing.T) {
+	h := MakeMulticastTestHarness(t)
+
+	a := h.Join()
+	h.VerifyOptionAck(a, "1")
+
+	a.SendSession(Ack(0))
+	h.VerifyGroupData(1)
+	a.SendSession(Ack(1))
+	h.VerifyGroupData(2)
+
+	// Duplicate ACKs don't get duplicate DATA.
+	a.SendSession(Ack(1))
+	h.VerifyGroupQuiet(h.options.Timeout / 2)
+
+	a.SendSession(Ack(2))
+	h.VerifyGroupData(3)
+	a.SendSession(Ack(3))
+	h.VerifyClosed()
+}
+
+// A client that joins mid-stream hears the rest of the stream, then catches up on the blocks it missed
+// once it becomes the master.
+func TestMulticastLateJoiner(t *testing.T) {
+	h := MakeMulticastTestHarness(t)
+
+	a := h.Join()
+	h.VerifyOptionAck(a, "1")
+	a.SendSession(Ack(0))
+	h.VerifyGroupData(1)
+	a.SendSession(Ack(1))
+	h.VerifyGroupData(2)
+
+	b := h.Join()
+	h.VerifyOptionAck(b, "0")
+	if !reflect.DeepEqual(a.sessionAddr, b.sessionAddr) {
+		t.Fatal("Members of a group should share a port")
+	}
+
+	// B hears block 3 along with A.
+	a.SendSession(Ack(2))
+	h.VerifyGroupData(3)
+	a.SendSession(Ack(3))
+
+	// A is done, so B becomes the master and asks for the blocks it missed.
+	h.VerifyOptionAck(b, "1")
+	b.SendSession(Ack(0))
+	h.VerifyGroupData(1)
+	b.SendSession(Ack(1))
+	h.VerifyGroupData(2)
+	b.SendSession(Ack(3))
+	h.VerifyClosed()
+}
+
+func TestMulticastMasterLeaves(t *testing.T) {
+	h := MakeMulticastTestHarness(t)
+
+	a := h.Join()
+	h.VerifyOptionAck(a, "1")
+	b := h.Join()
+	h.VerifyOptionAck(b, "0")
+
+	a.SendSession(MarshalPacket(&ErrorPacket{ERR_UNDEFINED, "Bye"}))
+	h.VerifyOptionAck(b, "1")
+	b.SendSession(Ack(3))
+	h.VerifyClosed()
+}
+
+// If the master stops responding, it's dropped after MaxRetries and the next member takes over.
+func TestMulticastMasterTimesOut(t *testing.T) {
+	h := MakeMulticastTestHarness(t)
+
+	a := h.Join()
+	h.VerifyOptionAck(a, "1")
+	b := h.Join()
+	h.VerifyOptionAck(b, "0")
+
+	for retry := 0; retry < h.options.MaxRetries; retry++ {
+		h.VerifyOptionAck(a, "1")
+	}
+
+	h.VerifyOptionAck(b, "1")
+	b.SendSession(Ack(3))
+	h.VerifyClosed()
+}
+
+// Requests that can't be multicast are left for a regular Connection.
+func TestMulticastDeclined(t *testing.T) {
+	h := MakeMulticastTestHarness(t)
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+
+	plain := MarshalPacket(&ReadRequestPacket{RequestPacket{"foo", "octet", nil}})
+	ErrorIf(t, h.groups.TryJoin(&h.options, addr, plain, h.fs), "Should not multicast without the option")
+
+	write := MarshalPacket(&WriteRequestPacket{RequestPacket{"foo", "octet", map[string]string{"multicast": ""}}})
+	ErrorIf(t, h.groups.TryJoin(&h.options, addr, write, h.fs), "Should not multicast a WRQ")
+
+	missing := MarshalPacket(&ReadRequestPacket{RequestPacket{"bar", "octet", map[string]string{"multicast": ""}}})
+	ErrorIf(t, h.groups.TryJoin(&h.options, addr, missing, h.fs), "Should not multicast a missing file")
+
+	// Files providers are consulted for first are read the way a ReadSession would, not from the store.
+	h.options.Providers = MakeContentProviders()
+	h.options.Providers.AddPrefix("f", ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		return strings.NewReader("generated"), nil
+	}))
+	generated := MarshalPacket(&ReadRequestPacket{RequestPacket{"foo", "octet", map[string]string{"multicast": ""}}})
+	ErrorIf(t, h.groups.TryJoin(&h.options, addr, generated, h.fs), "Should not multicast a generated file")
+
+	// Providers that don't have the file leave it to the store, which multicasts it.
+	h.options.Providers = MakeContentProviders()
+	h.options.Providers.AddPrefix("", ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		return nil, nil // Like templates, which only have the files they have templates for.
+	}))
+
+	client := h.Join()
+	h.VerifyOptionAck(client, "1")
+}
@@ -0,0 +1,280 @@
+// Origin.go fetches files we don't have from an HTTP origin, such as an artifact store.
+// Files are streamed to the client as they're downloaded, and cached in memory for the next client.
+// Cached files are revalidated with the origin (using ETag and Last-Modified) once they're older than MaxAge.
+// The cache is kept apart from the FileSystem, since a committed file would hide later changes at the origin.
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A ContentProvider fetching files from an HTTP origin.
+type OriginProvider struct {
+	Origin        string // Base URL; the filename is appended to it.
+	Client        *http.Client
+	MaxAge        time.Duration // How long a cached file is served before being revalidated.
+	MaxCacheBytes int           // Least recently used files are evicted to keep the cache under this size.
+	IdleTimeout   time.Duration // How long a download may go without sending anything before it's given up on.
+
+	Cache      map[string]*list.Element // Values are *CachedOriginFile.
+	Recent     list.List                // Most recently used at the front.
+	CacheBytes int
+	sync.Mutex // Guards the cache.
+}
+
+type CachedOriginFile struct {
+	Filename     string
+	Content      []byte
+	ETag         string
+	LastModified string
+	Validated    time.Time
+}
+
+// How long the origin has to start answering. Downloads themselves aren't limited, since large files
+// over slow links take as long as they take, but they're given up on if they stall for OriginIdleTimeout,
+// or when the transfer is aborted or ends.
+const OriginResponseTimeout = time.Minute
+const OriginIdleTimeout = 30 * time.Second
+
+func MakeOriginProvider(origin string, maxCacheBytes int, maxAge time.Duration) *OriginProvider {
+	transport := http.DefaultTransport.(*http.Transport).Clone() // Which also limits how long connecting takes.
+	transport.ResponseHeaderTimeout = OriginResponseTimeout
+
+	return &OriginProvider{
+		Origin:        strings.TrimSuffix(origin, "/"),
+		Client:        &http.Client{Transport: transport},
+		MaxAge:        maxAge,
+		MaxCacheBytes: maxCacheBytes,
+		IdleTimeout:   OriginIdleTimeout,
+		Cache:         make(map[string]*list.Element),
+	}
+}
+
+func (p *OriginProvider) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	fileURL, ok := p.URL(filename)
+	if !ok {
+		return nil, nil
+	}
+
+	cached := p.lookup(filename)
+	if cached != nil && time.Since(cached.Validated) < p.MaxAge {
+		return bytes.NewReader(cached.Content), nil
+	}
+
+	// The request lasts as long as the download, which the CachingReader ends.
+	ctx, stop := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			request.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		stop()
+		// Better a stale file than none at all.
+		if cached != nil {
+			Log.Println("Serving stale", filename, "since the origin failed:", err)
+			return bytes.NewReader(cached.Content), nil
+		}
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		Log.Println("Fetching", filename, "from origin")
+		return &CachingReader{
+			Body:        response.Body,
+			Request:     ctx,
+			Stop:        stop,
+			IdleTimeout: p.IdleTimeout,
+			MaxBytes:    p.MaxCacheBytes,
+			Done: func(content []byte) {
+				p.store(&CachedOriginFile{
+					Filename:     filename,
+					Content:      content,
+					ETag:         response.Header.Get("ETag"),
+					LastModified: response.Header.Get("Last-Modified"),
+					Validated:    time.Now(),
+				})
+			},
+		}, nil
+	case http.StatusNotModified:
+		response.Body.Close()
+		stop()
+		if cached == nil {
+			return nil, fmt.Errorf("Origin sent 304 for %s, which we don't have", filename)
+		}
+		p.revalidated(cached)
+		return bytes.NewReader(cached.Content), nil
+	case http.StatusNotFound:
+		response.Body.Close()
+		stop()
+		p.evict(filename)
+		return nil, nil
+	default:
+		response.Body.Close()
+		stop()
+		return nil, fmt.Errorf("Origin sent %s for %s", response.Status, filename)
+	}
+}
+
+// Returns the origin's URL for the file. Filenames that could escape the origin's base path aren't fetched.
+func (p *OriginProvider) URL(filename string) (string, bool) {
+	segments := strings.Split(strings.TrimPrefix(filename, "/"), "/")
+	for i, segment := range segments {
+		if segment == ".." || segment == "." {
+			return "", false
+		}
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return p.Origin + "/" + strings.Join(segments, "/"), true
+}
+
+func (p *OriginProvider) lookup(filename string) *CachedOriginFile {
+	p.Lock()
+	defer p.Unlock()
+
+	element := p.Cache[filename]
+	if element == nil {
+		return nil
+	}
+	p.Recent.MoveToFront(element)
+	return element.Value.(*CachedOriginFile)
+}
+
+func (p *OriginProvider) revalidated(cached *CachedOriginFile) {
+	p.Lock()
+	defer p.Unlock()
+
+	cached.Validated = time.Now()
+}
+
+// Caches a file, evicting the least recently used files to make room.
+func (p *OriginProvider) store(file *CachedOriginFile) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.remove(file.Filename)
+	if len(file.Content) > p.MaxCacheBytes {
+		return
+	}
+
+	for p.CacheBytes+len(file.Content) > p.MaxCacheBytes {
+		p.remove(p.Recent.Back().Value.(*CachedOriginFile).Filename)
+	}
+
+	p.Cache[file.Filename] = p.Recent.PushFront(file)
+	p.CacheBytes += len(file.Content)
+}
+
+func (p *OriginProvider) evict(filename string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.remove(filename)
+}
+
+// Must be called with the lock held.
+func (p *OriginProvider) remove(filename string) {
+	element := p.Cache[filename]
+	if element == nil {
+		return
+	}
+
+	p.CacheBytes -= len(element.Value.(*CachedOriginFile).Content)
+	p.Recent.Remove(element)
+	delete(p.Cache, filename)
+}
+
+// Passes a download through to the client, keeping a copy of it.
+// Done is called with the copy once the download completes, unless it was larger than MaxBytes.
+type CachingReader struct {
+	Body        io.ReadCloser
+	Request     context.Context    // The request's context, which ends with the download.
+	Stop        context.CancelFunc // Ends the request, which also wakes a Read waiting on it.
+	IdleTimeout time.Duration      // How long each Read may wait. Unlimited if 0.
+	Copy        bytes.Buffer
+	MaxBytes    int
+	TooLarge    bool
+	Finished    bool
+	Done        func(content []byte)
+}
+
+func (r *CachingReader) Read(buffer []byte) (int, error) {
+	if r.Finished {
+		return 0, io.EOF
+	}
+
+	var idle *time.Timer
+	if r.IdleTimeout > 0 {
+		idle = time.AfterFunc(r.IdleTimeout, r.Stop)
+	}
+	bytesRead, err := r.Body.Read(buffer)
+	if idle != nil && !idle.Stop() && err != nil {
+		err = fmt.Errorf("Origin sent nothing for %v: %v", r.IdleTimeout, err)
+	}
+
+	if !r.TooLarge {
+		r.Copy.Write(buffer[:bytesRead])
+		if r.Copy.Len() > r.MaxBytes {
+			r.TooLarge = true
+			r.Copy = bytes.Buffer{}
+		}
+	}
+
+	if err != nil {
+		r.Finished = true
+		r.Body.Close()
+		r.Stop()
+		if err == io.EOF && !r.TooLarge {
+			r.Done(r.Copy.Bytes())
+		}
+	}
+
+	return bytesRead, err
+}
+
+// Abandons the download, e.g. when the client gives up on it. Nothing is cached.
+func (r *CachingReader) Close() error {
+	if r.Finished {
+		return nil
+	}
+	r.Finished = true
+	r.Stop()
+	return r.Body.Close()
+}
+
+// Ends the download once cancel is closed, e.g. when the transfer is aborted, even while it's being read.
+func (r *CachingReader) StopOn(cancel <-chan struct{}) {
+	if cancel == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-cancel:
+			r.Stop()
+		case <-r.Request.Done():
+		}
+	}()
+}
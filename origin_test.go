@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// An HTTP origin serving files from a map, with ETags, counting what it's asked.
+type TestOrigin struct {
+	Files       map[string]string
+	ETags       map[string]string
+	Requests    int
+	NotModified int
+}
+
+func (o *TestOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.Requests++
+
+	content, exists := o.Files[r.URL.Path]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := o.ETags[r.URL.Path]
+	if etag != "" && r.Header.Get("If-None-Match") == etag {
+		o.NotModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	io.WriteString(w, content)
+}
+
+func Fetch(t *testing.T, provider *OriginProvider, filename string) string {
+	stream, err := provider.Provide(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream == nil {
+		return ""
+	}
+	content, _ := io.ReadAll(stream)
+	return string(content)
+}
+
+func TestOriginFetchAndRevalidate(t *testing.T) {
+	origin := &TestOrigin{
+		Files: map[string]string{"/images/vmlinuz": "kernel-v1", "/with space": "spaced"},
+		ETags: map[string]string{"/images/vmlinuz": `"v1"`},
+	}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	provider := MakeOriginProvider(server.URL+"/", 1024, 0)
+
+	ErrorIf(t, Fetch(t, provider, "images/vmlinuz") != "kernel-v1", "First fetch wrong")
+	ErrorIf(t, provider.CacheBytes != len("kernel-v1"), "Fetched file should be cached")
+
+	// MaxAge is zero, so the cached copy is revalidated every time.
+	ErrorIf(t, Fetch(t, provider, "images/vmlinuz") != "kernel-v1", "Revalidated fetch wrong")
+	ErrorIf(t, origin.NotModified != 1, "Expected a conditional request")
+
+	origin.Files["/images/vmlinuz"] = "kernel-v2"
+	origin.ETags["/images/vmlinuz"] = `"v2"`
+	ErrorIf(t, Fetch(t, provider, "images/vmlinuz") != "kernel-v2", "Changed file should be re-fetched")
+
+	ErrorIf(t, Fetch(t, provider, "with space") != "spaced", "Filenames should be escaped")
+	ErrorIf(t, Fetch(t, provider, "missing") != "", "Missing files should not be provided")
+	ErrorIf(t, Fetch(t, provider, "../secret") != "", "Filenames should not escape the origin")
+
+	// Fresh files aren't revalidated, and stale ones are served if the origin goes away.
+	provider.MaxAge = time.Hour
+	requests := origin.Requests
+	ErrorIf(t, Fetch(t, provider, "images/vmlinuz") != "kernel-v2", "Fresh fetch wrong")
+	ErrorIf(t, origin.Requests != requests, "Fresh files should not be revalidated")
+
+	provider.MaxAge = 0
+	server.Close()
+	ErrorIf(t, Fetch(t, provider, "images/vmlinuz") != "kernel-v2", "Stale file should be served when the origin is down")
+}
+
+func TestOriginCacheBound(t *testing.T) {
+	origin := &TestOrigin{Files: map[string]string{"/a": "aaaa", "/b": "bbbb", "/c": "cccc", "/big": "0123456789"}}
+	server := httptest.NewServer(origin)
+	defer server.Close()
+
+	provider := MakeOriginProvider(server.URL, 8, time.Hour)
+
+	Fetch(t, provider, "a")
+	Fetch(t, provider, "b")
+	Fetch(t, provider, "a") // Now b is the least recently used.
+	Fetch(t, provider, "c")
+	ErrorIf(t, provider.CacheBytes > 8, "Cache should stay under its bound")
+	ErrorIf(t, provider.Cache["b"] != nil, "Least recently used file should have been evicted")
+	ErrorIf(t, provider.Cache["a"] == nil || provider.Cache["c"] == nil, "Recently used files should be cached")
+
+	// Files too large for the cache are still served.
+	ErrorIf(t, Fetch(t, provider, "big") != "0123456789", "Large file fetch wrong")
+	ErrorIf(t, provider.Cache["big"] != nil, "Large file should not be cached")
+}
+
+// Files from the origin are served through a ReadSession when the FileSystem misses.
+func TestOriginSession(t *testing.T) {
+	content := string(MakeTestContent(1, FullDataPayloadLength+5))
+	server := httptest.NewServer(&TestOrigin{Files: map[string]string{"/foo": content}})
+	defer server.Close()
+
+	h := TestHarness{t}
+	rs := MakeReadSession(MakeFileSystem())
+	rs.Providers = MakeContentProviders()
+	rs.Providers.AddFallback(MakeOriginProvider(server.URL, 1<<20, time.Hour))
+
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octet", nil}}, &DataPacket{1, []byte(content[:FullDataPayloadLength])})
+	h.Verify(rs, &AckPacket{1}, &DataPacket{2, []byte(content[FullDataPayloadLength:])})
+	h.Verify(rs, &AckPacket{2}, nil)
+	h.VerifyDead(rs)
+
+	// Abandoned downloads are closed, and not cached.
+	provider := MakeOriginProvider(server.URL, 1<<20, time.Hour)
+	rs = MakeReadSession(MakeFileSystem())
+	rs.Providers = MakeContentProviders()
+	rs.Providers.AddFallback(provider)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octet", nil}}, &DataPacket{1, []byte(content[:FullDataPayloadLength])})
+	rs.Close()
+	download := rs.Reader.(*StreamReader).Stream.(*CachingReader)
+	ErrorIf(t, !download.Finished, "Abandoned downloads should be closed")
+	ErrorIf(t, provider.Cache["foo"] != nil, "Abandoned downloads shouldn't be cached")
+}
+
+// Slow downloads are served however long they take, but an origin that doesn't answer is given up on.
+func TestOriginSlowDownload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/silent" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "second")
+	}))
+	defer server.Close()
+
+	provider := MakeOriginProvider(server.URL, 1<<20, time.Hour)
+	provider.Client.Transport.(*http.Transport).ResponseHeaderTimeout = 100 * time.Millisecond
+
+	ErrorIf(t, Fetch(t, provider, "slow") != "first second", "Slow downloads should be read to the end")
+	_, err := provider.Provide("silent", nil)
+	ErrorIf(t, err == nil, "Origins that don't answer should fail")
+}
+
+// Downloads that stall part way through are given up on once they've been idle too long, or the transfer's aborted.
+func TestOriginStalledDownload(t *testing.T) {
+	content := MakeTestContent(1, FullDataPayloadLength+100)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+		w.(http.Flusher).Flush()
+		select { // The rest never comes.
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	h := TestHarness{t}
+	provider := MakeOriginProvider(server.URL, 1<<20, time.Hour)
+	Read := func(cancel chan struct{}) *ReadSession {
+		rs := MakeReadSession(MakeFileSystem())
+		rs.Providers = MakeContentProviders()
+		rs.Providers.AddFallback(provider)
+		rs.Cancel = cancel
+		request := &ReadRequestPacket{RequestPacket{"stalls", "octet", nil}}
+		h.Verify(rs, request, &DataPacket{1, content[:FullDataPayloadLength]})
+		return rs
+	}
+	failed := &ErrorPacket{ERR_UNDEFINED, "Failed to read file"}
+
+	provider.IdleTimeout = 50 * time.Millisecond
+	rs := Read(nil)
+	VerifyReply(t, DispatchLater(rs, &AckPacket{1}), failed)
+
+	provider.IdleTimeout = 0
+	cancel := make(chan struct{})
+	rs = Read(cancel)
+	reply := DispatchLater(rs, &AckPacket{1})
+	VerifyWaiting(t, reply)
+	close(cancel)
+	VerifyReply(t, reply, failed)
+	ErrorIf(t, provider.Cache["stalls"] != nil, "Stalled downloads shouldn't be cached")
+}
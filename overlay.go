@@ -0,0 +1,110 @@
+// Overlay.go merges read-only layers, like a base image directory, with the FileSystem into one tree.
+// Reads look in the FileSystem first and then in each layer in turn, so an upload shadows the file of the same
+// name in the layers below. Uploads are always written to the FileSystem. Deleting a file leaves a whiteout that
+// hides the name in every layer below, until it's uploaded again; renaming a file whites out its old name.
+// Whiteouts are kept by the FileSystem, so they're saved in snapshots with the files.
+// Generated content, like templates, can be a layer of its own, or sit above the FileSystem as a prefixed provider.
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A ContentProvider serving the layers under the FileSystem, unless the name has been whited out.
+// It should be the first fallback, so whiteouts hide the fallbacks after it too.
+type Overlay struct {
+	Fs     *FileSystem
+	Layers []ContentProvider // Top first.
+}
+
+func MakeOverlay(fs *FileSystem, layers ...ContentProvider) *Overlay {
+	fs.Lock()
+	if fs.Whiteouts == nil {
+		fs.Whiteouts = make(map[string]bool)
+	}
+	fs.Unlock()
+
+	return &Overlay{Fs: fs, Layers: layers}
+}
+
+func (o *Overlay) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	if o.Fs.WhitedOut(filename) {
+		return nil, &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
+	}
+
+	for _, layer := range o.Layers {
+		stream, err := layer.Provide(filename, client)
+		if stream != nil || err != nil {
+			return stream, err
+		}
+	}
+	return nil, nil
+}
+
+// Makes an overlay of read-only directories given like "/srv/site,/srv/base".
+func LoadOverlay(fs *FileSystem, spec string) (*Overlay, error) {
+	var layers []ContentProvider
+	for _, dir := range strings.Split(spec, ",") {
+		layer, err := MakeDirectoryProvider(dir)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return MakeOverlay(fs, layers...), nil
+}
+
+// Whether the file has been deleted from the layers under the FileSystem.
+func (f *FileSystem) WhitedOut(filename string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.Whiteouts[filename]
+}
+
+// Hides the name in the layers under the FileSystem, if it's part of an overlay. Must be called with the lock held.
+func (f *FileSystem) whiteOut(filename string) {
+	if f.Whiteouts != nil && !f.Whiteouts[filename] {
+		f.Whiteouts[filename] = true
+		f.Generation++
+	}
+}
+
+// Serves the files in a directory, read-only. Nothing outside the directory can be read, even through symlinks.
+type DirectoryProvider struct {
+	Root *os.Root
+}
+
+func MakeDirectoryProvider(dir string) (*DirectoryProvider, error) {
+	root, err := os.OpenRoot(dir) // Kept open for as long as we serve the directory.
+	if err != nil {
+		return nil, err
+	}
+	return &DirectoryProvider{Root: root}, nil
+}
+
+func (p *DirectoryProvider) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	name := filepath.FromSlash(CleanMemberName(filename))
+	if !filepath.IsLocal(name) {
+		return nil, nil
+	}
+
+	file, err := p.Root.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, err
+	}
+	return &ClosingReader{Stream: file}, nil
+}
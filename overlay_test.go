@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	h := TestHarness{t}
+	site, base, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(site, "pxelinux.cfg"), []byte("site"), 0644)
+	os.WriteFile(filepath.Join(base, "pxelinux.cfg"), []byte("base"), 0644)
+	os.WriteFile(filepath.Join(base, "kernel"), []byte("kernel"), 0644)
+	os.Mkdir(filepath.Join(base, "images"), 0755)
+	os.WriteFile(filepath.Join(base, "images", "initrd"), []byte("initrd"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(base, "escape"))
+
+	fs := MakeFileSystem()
+	overlay, err := LoadOverlay(fs, site+","+base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay.Layers = append(overlay.Layers, ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		if filename != "generated" {
+			return nil, nil
+		}
+		return strings.NewReader("generated"), nil
+	}))
+	providers := MakeContentProviders()
+	providers.AddFallback(overlay)
+
+	Read := func(filename string, expected Packet) {
+		rs := MakeReadSession(fs)
+		rs.Providers = providers
+		h.Verify(rs, &ReadRequestPacket{RequestPacket{filename, "octet", nil}}, expected)
+	}
+	NotFound := &ErrorPacket{ERR_FILE_NOT_FOUND, ""}
+
+	// Upper layers shadow lower ones.
+	Read("pxelinux.cfg", &DataPacket{1, []byte("site")})
+	Read("kernel", &DataPacket{1, []byte("kernel")})
+	Read("images/initrd", &DataPacket{1, []byte("initrd")})
+	Read("generated", &DataPacket{1, []byte("generated")})
+	Read("images", NotFound)
+	Read("../"+filepath.Base(outside)+"/secret", NotFound)
+	Read("escape", &ErrorPacket{ERR_UNDEFINED, "Failed to generate file"})
+
+	// Uploads go to the FileSystem, above every layer.
+	StoreTestFile(fs, "kernel", []byte("uploaded"))
+	Read("kernel", &DataPacket{1, []byte("uploaded")})
+
+	// Deleting leaves a whiteout, so the layers below don't show through.
+	ErrorIf(t, fs.Delete("kernel") != nil, "Deleting an upload should work")
+	Read("kernel", NotFound)
+	ErrorIf(t, fs.Delete("pxelinux.cfg") != nil, "Deleting from a layer should work")
+	Read("pxelinux.cfg", NotFound)
+	ErrorIf(t, fs.Delete("generated") != nil, "Deleting generated files should work")
+	Read("generated", NotFound)
+
+	// Until the file is uploaded again.
+	StoreTestFile(fs, "pxelinux.cfg", []byte("again"))
+	Read("pxelinux.cfg", &DataPacket{1, []byte("again")})
+
+	// Renaming whites out the old name.
+	StoreTestFile(fs, "images/initrd", []byte("new initrd"))
+	ErrorIf(t, fs.Rename("images/initrd", "images/initrd.old") != nil, "Rename should work")
+	Read("images/initrd", NotFound)
+	Read("images/initrd.old", &DataPacket{1, []byte("new initrd")})
+
+	// Whiteouts survive a snapshot.
+	var archive bytes.Buffer
+	if err := WriteSnapshot(fs, &archive); err != nil {
+		t.Fatal(err)
+	}
+	restored := MakeFileSystem()
+	MakeOverlay(restored)
+	if err := ReadSnapshot(restored, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	ErrorIf(t, !restored.WhitedOut("kernel") || !restored.WhitedOut("images/initrd"), "Snapshots should keep whiteouts")
+	ErrorIf(t, restored.WhitedOut("pxelinux.cfg"), "Files uploaded again shouldn't be whited out")
+	ErrorIf(t, ReadTestFile(restored, "images/initrd.old") != "new initrd", "Snapshots should keep files")
+
+	// A FileSystem without layers has no whiteouts.
+	plain := MakeFileSystem()
+	ErrorIf(t, ReadSnapshot(plain, bytes.NewReader(archive.Bytes())) != nil || plain.Whiteouts != nil, "Whiteouts should be ignored without layers")
+	ErrorIf(t, plain.Delete("kernel") == nil, "Deleting a missing file without layers should fail")
+
+	_, err = LoadOverlay(MakeFileSystem(), filepath.Join(base, "missing"))
+	ErrorIf(t, err == nil, "Missing layers should fail to load")
+}
@@ -1,7 +1,11 @@
 // Packet.go defines the data structures of the TFTP protocol.
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // Packet opcodes:
 const (
@@ -10,6 +14,7 @@ const (
 	PKT_DATA  = 3
 	PKT_ACK   = 4
 	PKT_ERROR = 5
+	PKT_OACK  = 6
 )
 
 // Packet error codes:
@@ -21,14 +26,17 @@ const (
 //   5         Unknown transfer ID.
 //   6         File already exists.
 //   7         No such user.
+//   8         Terminate transfer due to option negotiation (RFC 2347).
 const (
 	ERR_UNDEFINED           = iota
 	ERR_FILE_NOT_FOUND      = iota
 	ERR_ACCESS_VIOLATION    = iota
 	ERR_DISK_FULL           = iota
 	ERR_ILLEGAL_OPERATION   = iota
+	ERR_UNKNOWN_TRANSFER_ID = iota
 	ERR_FILE_ALREADY_EXISTS = iota
 	ERR_NO_SUCH_USER        = iota
+	ERR_OPTION_NEGOTIATION  = iota
 )
 
 // Maximum size of a DATA packet payload. If a packet is received with len < 512,
@@ -38,6 +46,36 @@ const FullDataPayloadLength = 512
 // Largest byte array length possible for any packet.
 const MaxPacketSize = FullDataPayloadLength + 4
 
+// Reasons a packet can fail to decode:
+const (
+	DECODE_TOO_SHORT           = iota
+	DECODE_TOO_LONG            = iota
+	DECODE_UNKNOWN_OPCODE      = iota
+	DECODE_UNTERMINATED_STRING = iota
+)
+
+// Describes why a packet couldn't be decoded.
+// Decoding never panics; every malformed input is reported with one of these.
+type DecodeError struct {
+	Reason int
+	Opcode uint16 // Zero if the packet was too short to have one.
+}
+
+func (e *DecodeError) Error() string {
+	switch e.Reason {
+	case DECODE_TOO_SHORT:
+		return "Packet too short"
+	case DECODE_TOO_LONG:
+		return "Packet too long"
+	case DECODE_UNKNOWN_OPCODE:
+		return fmt.Sprintf("Unknown opcode %d", e.Opcode)
+	case DECODE_UNTERMINATED_STRING:
+		return "String not null-terminated"
+	default:
+		return "Malformed packet"
+	}
+}
+
 // Provides methods for marshalling and unmarshalling between typed packets and byte arrays.
 type Packet interface {
 	Unmarshal(data []byte) error
@@ -45,13 +83,15 @@ type Packet interface {
 	GetOpcode() uint16
 }
 
-//          2 bytes    string   1 byte     string   1 byte
-//          -----------------------------------------------
-//   RRQ/  | 01/02 |  Filename  |   0  |    Mode    |   0  |
-//   WRQ    -----------------------------------------------
+//          2 bytes    string   1 byte     string   1 byte   string  1 byte  string  1 byte
+//          ---------------------------------------------------------------------------
+//   RRQ/  | 01/02 |  Filename  |   0  |    Mode    |   0  |  opt1  |   0  | value1 |   0  | ...
+//   WRQ    ---------------------------------------------------------------------------
+// The option/value pairs are from RFC 2347, and are absent in plain RFC 1350 requests.
 type RequestPacket struct {
 	Filename string
 	Mode     string
+	Options  map[string]string // Keyed by lower-cased option name. Nil if no options were given.
 }
 
 type ReadRequestPacket struct {
@@ -89,19 +129,29 @@ type ErrorPacket struct {
 	ErrMsg string
 }
 
+//          2 bytes    string   1 byte   string   1 byte
+//          -------------------------------------------------
+//   OACK  | 06    |   opt1   |   0  |  value1  |   0  | ...
+//          -------------------------------------------------
+// Acknowledges the RFC 2347 options of a request that the server agreed to.
+type OptionAckPacket struct {
+	Options map[string]string
+}
+
 // Opcodes
 func (p *ReadRequestPacket) GetOpcode() uint16  { return PKT_RRQ }
 func (p *WriteRequestPacket) GetOpcode() uint16 { return PKT_WRQ }
 func (p *DataPacket) GetOpcode() uint16         { return PKT_DATA }
 func (p *AckPacket) GetOpcode() uint16          { return PKT_ACK }
 func (p *ErrorPacket) GetOpcode() uint16        { return PKT_ERROR }
+func (p *OptionAckPacket) GetOpcode() uint16    { return PKT_OACK }
 
 // Request Packet
 func (p *RequestPacket) Marshal() []byte {
 	result := make([]byte, len(p.Filename)+1+len(p.Mode)+1)
 	copy(result, p.Filename)
 	copy(result[len(p.Filename)+1:], p.Mode)
-	return result
+	return append(result, MarshalOptions(p.Options)...)
 }
 
 func (p *RequestPacket) Unmarshal(data []byte) error {
@@ -115,8 +165,14 @@ func (p *RequestPacket) Unmarshal(data []byte) error {
 		return err
 	}
 
+	options, err := ParseOptions(data[1+len(filename)+1+len(mode):])
+	if err != nil {
+		return err
+	}
+
 	p.Filename = filename
 	p.Mode = mode
+	p.Options = options
 
 	return nil
 }
@@ -129,9 +185,13 @@ func (p *DataPacket) Marshal() []byte {
 	return result
 }
 
+// The last DATA packet of a file that's a multiple of 512 bytes long has no data at all.
 func (p *DataPacket) Unmarshal(data []byte) error {
-	if len(data) < 3 {
-		return fmt.Errorf("Input too small.")
+	if len(data) < 2 {
+		return &DecodeError{DECODE_TOO_SHORT, PKT_DATA}
+	}
+	if len(data) > 2+FullDataPayloadLength {
+		return &DecodeError{DECODE_TOO_LONG, PKT_DATA}
 	}
 
 	p.Block = ConvertToUInt16(data[:2])
@@ -148,9 +208,14 @@ func (p *ErrorPacket) Marshal() []byte {
 	return result
 }
 
+// ErrorPackets can be returned as errors, to say exactly what the remote host should be told.
+func (p *ErrorPacket) Error() string {
+	return fmt.Sprintf("TFTP error %d: %s", p.ErrorCode, p.ErrMsg)
+}
+
 func (p *ErrorPacket) Unmarshal(data []byte) error {
 	if len(data) < 3 {
-		return fmt.Errorf("Input too small.")
+		return &DecodeError{DECODE_TOO_SHORT, PKT_ERROR}
 	}
 
 	p.ErrorCode = ConvertToUInt16(data[:2])
@@ -169,12 +234,29 @@ func (p *AckPacket) Marshal() []byte {
 	return ConvertFromUInt16(p.Block)
 }
 
+// Some clients pad their ACKs, so trailing bytes are ignored.
 func (p *AckPacket) Unmarshal(data []byte) error {
-	if len(data) != 2 {
-		return fmt.Errorf("Input wrong size.")
+	if len(data) < 2 {
+		return &DecodeError{DECODE_TOO_SHORT, PKT_ACK}
+	}
+
+	p.Block = ConvertToUInt16(data[:2])
+
+	return nil
+}
+
+// Option Ack Packet
+func (p *OptionAckPacket) Marshal() []byte {
+	return MarshalOptions(p.Options)
+}
+
+func (p *OptionAckPacket) Unmarshal(data []byte) error {
+	options, err := ParseOptions(data)
+	if err != nil {
+		return err
 	}
 
-	p.Block = ConvertToUInt16(data)
+	p.Options = options
 
 	return nil
 }
@@ -187,19 +269,29 @@ var packetTypes = map[uint16]func() Packet{
 	PKT_DATA:  func() Packet { return new(DataPacket) },
 	PKT_ACK:   func() Packet { return new(AckPacket) },
 	PKT_ERROR: func() Packet { return new(ErrorPacket) },
+	PKT_OACK:  func() Packet { return new(OptionAckPacket) },
 }
 
+// Returns a *DecodeError if the data isn't a well-formed packet.
 func UnmarshalPacket(data []byte) (Packet, error) {
-	if len(data) < 3 {
-		return nil, fmt.Errorf("Input too small.")
+	if len(data) < 2 {
+		return nil, &DecodeError{DECODE_TOO_SHORT, 0}
 	}
 
 	opcode := ConvertToUInt16(data[:2])
 	payload := data[2:]
 
-	packet := packetTypes[opcode]()
+	makePacket, known := packetTypes[opcode]
+	if !known {
+		return nil, &DecodeError{DECODE_UNKNOWN_OPCODE, opcode}
+	}
+
+	packet := makePacket()
 	err := packet.Unmarshal(payload)
 	if err != nil {
+		if decodeErr, isDecodeErr := err.(*DecodeError); isDecodeErr {
+			decodeErr.Opcode = opcode
+		}
 		return nil, err
 	}
 
@@ -207,12 +299,63 @@ func UnmarshalPacket(data []byte) (Packet, error) {
 }
 
 func MarshalPacket(packet Packet) []byte {
-	data := make([]byte, MaxPacketSize)
 	marshalled := packet.Marshal()
+	data := make([]byte, 2+len(marshalled))
 	copy(data[2:], marshalled)
 	copy(data[:2], ConvertFromUInt16(packet.GetOpcode()))
 
-	return data[:2+len(marshalled)]
+	return data
+}
+
+// Option methods:
+
+// Parses the RFC 2347 option/value pairs trailing a request.
+// Option names are case-insensitive, so they're lower-cased. If an option is repeated, the first one wins.
+// Returns nil if there are no options.
+func ParseOptions(data []byte) (map[string]string, error) {
+	var options map[string]string
+
+	for len(data) > 0 {
+		name, err := ExtractNullTerminatedString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[len(name)+1:]
+
+		value, err := ExtractNullTerminatedString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[len(value)+1:]
+
+		if options == nil {
+			options = make(map[string]string)
+		}
+		name = strings.ToLower(name)
+		if _, exists := options[name]; !exists {
+			options[name] = value
+		}
+	}
+
+	return options, nil
+}
+
+// Marshals options as null-terminated option/value pairs, sorted by name so the output is stable.
+func MarshalOptions(options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []byte
+	for _, name := range names {
+		result = append(result, name...)
+		result = append(result, 0)
+		result = append(result, options[name]...)
+		result = append(result, 0)
+	}
+	return result
 }
 
 // Conversion helper methods:
@@ -224,7 +367,7 @@ func ExtractNullTerminatedString(data []byte) (string, error) {
 		}
 	}
 
-	return "", fmt.Errorf("No null encountered.")
+	return "", &DecodeError{DECODE_UNTERMINATED_STRING, 0}
 }
 
 func ConvertToUInt16(buffer []byte) uint16 {
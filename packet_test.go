@@ -2,6 +2,7 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -18,7 +19,7 @@ func TestPacketMarshalling(t *testing.T) {
 		// Read Request
 		{
 			[]byte{'f', 'o', 'o', 0, 'o', 'c', 't', 'a', 'l', 0},
-			&ReadRequestPacket{RequestPacket{"foo", "octal"}},
+			&ReadRequestPacket{RequestPacket{"foo", "octal", nil}},
 			&ReadRequestPacket{},
 		},
 		{
@@ -31,10 +32,20 @@ func TestPacketMarshalling(t *testing.T) {
 			nil,
 			&ReadRequestPacket{},
 		},
+		{
+			[]byte{'f', 'o', 'o', 0, 'o', 'c', 't', 'e', 't', 0, 'b', 'l', 'k', 's', 'i', 'z', 'e', 0, '8', 0},
+			&ReadRequestPacket{RequestPacket{"foo", "octet", map[string]string{"blksize": "8"}}},
+			&ReadRequestPacket{},
+		},
+		{
+			[]byte{'f', 'o', 'o', 0, 'o', 'c', 't', 'e', 't', 0, 't', 's', 'i', 'z', 'e', 0},
+			nil,
+			&ReadRequestPacket{},
+		},
 		// Write Request
 		{
 			[]byte{'f', 'o', 'o', 0, 'o', 'c', 't', 'a', 'l', 0},
-			&WriteRequestPacket{RequestPacket{"foo", "octal"}},
+			&WriteRequestPacket{RequestPacket{"foo", "octal", nil}},
 			&WriteRequestPacket{},
 		},
 		// Data
@@ -50,6 +61,16 @@ func TestPacketMarshalling(t *testing.T) {
 		},
 		{
 			[]byte{0, 1},
+			&DataPacket{1, []byte{}}, // The last block of a file that's a multiple of 512 bytes long.
+			&DataPacket{},
+		},
+		{
+			[]byte{0},
+			nil,
+			&DataPacket{},
+		},
+		{
+			make([]byte, 2+FullDataPayloadLength+1),
 			nil,
 			&DataPacket{},
 		},
@@ -58,6 +79,12 @@ func TestPacketMarshalling(t *testing.T) {
 		{[]byte{0}, nil, &AckPacket{}},
 		{[]byte{0xFF, 0xFE}, &AckPacket{65534}, &AckPacket{}},
 		{[]byte{0xFF}, nil, &AckPacket{}},
+		// Option Ack
+		{
+			[]byte{'m', 'u', 'l', 't', 'i', 'c', 'a', 's', 't', 0, '1', 0},
+			&OptionAckPacket{map[string]string{"multicast": "1"}},
+			&OptionAckPacket{},
+		},
 		// Err
 		{
 			[]byte{0x00, 0x01, byte('h'), byte('i'), 0x00},
@@ -108,3 +135,120 @@ func TestPacketMarshalling(t *testing.T) {
 		}
 	}
 }
+
+// Some clients pad their ACKs. The padding is ignored.
+func TestAckTrailingBytes(t *testing.T) {
+	packet, err := UnmarshalPacket([]byte{0, PKT_ACK, 0, 7, 0, 0})
+	ErrorIf(t, err != nil, "Padded ACK should decode")
+	ErrorIf(t, !reflect.DeepEqual(packet, &AckPacket{7}), "Padded ACK decoded wrong")
+}
+
+type DecodeTestCase struct {
+	Data   []byte
+	Reason int
+	Opcode uint16
+}
+
+// Tests that every kind of malformed packet is reported with the right DecodeError, rather than a panic.
+func TestDecodeErrors(t *testing.T) {
+	tests := []DecodeTestCase{
+		{[]byte{}, DECODE_TOO_SHORT, 0},
+		{[]byte{0}, DECODE_TOO_SHORT, 0},
+		{[]byte{0, 0, 'x'}, DECODE_UNKNOWN_OPCODE, 0},
+		{[]byte{0, 7, 'x'}, DECODE_UNKNOWN_OPCODE, 7},
+		{[]byte{0, PKT_OACK, 'x'}, DECODE_UNTERMINATED_STRING, PKT_OACK},
+		{[]byte{0xFF, 0xFF}, DECODE_UNKNOWN_OPCODE, 0xFFFF},
+		{[]byte{0, PKT_RRQ}, DECODE_UNTERMINATED_STRING, PKT_RRQ},
+		{[]byte{0, PKT_WRQ, 'a', 0, 'b'}, DECODE_UNTERMINATED_STRING, PKT_WRQ},
+		{[]byte{0, PKT_DATA, 0}, DECODE_TOO_SHORT, PKT_DATA},
+		{make([]byte, MaxPacketSize+1), DECODE_UNKNOWN_OPCODE, 0},
+		{append([]byte{0, PKT_DATA}, make([]byte, MaxPacketSize)...), DECODE_TOO_LONG, PKT_DATA},
+		{[]byte{0, PKT_ACK, 1}, DECODE_TOO_SHORT, PKT_ACK},
+		{[]byte{0, PKT_ERROR, 0, 1}, DECODE_TOO_SHORT, PKT_ERROR},
+		{[]byte{0, PKT_ERROR, 0, 1, 'x'}, DECODE_UNTERMINATED_STRING, PKT_ERROR},
+	}
+
+	for k, test := range tests {
+		packet, err := UnmarshalPacket(test.Data)
+		decodeErr, isDecodeErr := err.(*DecodeError)
+		if packet != nil || !isDecodeErr {
+			t.Fatalf("Test %d failed: expected DecodeError, got %v, %v", k, packet, err)
+		}
+		if decodeErr.Reason != test.Reason || decodeErr.Opcode != test.Opcode {
+			t.Fatalf("Test %d failed: expected reason %d opcode %d, got %v", k, test.Reason, test.Opcode, decodeErr)
+		}
+	}
+}
+
+// Option names are case-insensitive, and the first of a repeated option wins.
+func TestParseOptions(t *testing.T) {
+	options, err := ParseOptions([]byte("TSize\x000\x00blksize\x001428\x00tsize\x0099\x00"))
+	ErrorIf(t, err != nil, "Options should parse")
+	ErrorIf(t, !reflect.DeepEqual(options, map[string]string{"tsize": "0", "blksize": "1428"}), "Options parsed wrong")
+
+	options, err = ParseOptions(nil)
+	ErrorIf(t, err != nil || options != nil, "No options should parse to nil")
+}
+
+func AddPacketSeeds(f *testing.F) {
+	f.Add([]byte{0, PKT_RRQ, 'f', 'o', 'o', 0, 'o', 'c', 't', 'e', 't', 0})
+	f.Add([]byte{0, PKT_WRQ, 'f', 'o', 'o', 0, 'n', 'e', 't', 'a', 's', 'c', 'i', 'i', 0})
+	f.Add([]byte{0, PKT_DATA, 0, 1, 'h', 'i'})
+	f.Add([]byte{0, PKT_DATA, 0, 1})
+	f.Add([]byte{0, PKT_ACK, 0, 1})
+	f.Add([]byte{0, PKT_ACK, 0, 1, 0, 0})
+	f.Add([]byte{0, PKT_ERROR, 0, 1, 'n', 'o', 0})
+	f.Add([]byte{0, PKT_OACK, 'a', 0, 'b', 0})
+	f.Add([]byte{0, 7, 0, 0})
+}
+
+// Anything UnmarshalPacket accepts must survive a trip through MarshalPacket unchanged.
+// Anything it rejects must be rejected with a DecodeError. It must never panic.
+func FuzzUnmarshalPacket(f *testing.F) {
+	AddPacketSeeds(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := UnmarshalPacket(data)
+		if err != nil {
+			if _, isDecodeErr := err.(*DecodeError); !isDecodeErr {
+				t.Fatalf("Expected DecodeError, got %T: %v", err, err)
+			}
+			return
+		}
+
+		marshalled := MarshalPacket(packet)
+		roundTripped, err := UnmarshalPacket(marshalled)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %v after marshalling it to %v: %v", packet, marshalled, err)
+		}
+		if !reflect.DeepEqual(packet, roundTripped) {
+			t.Fatalf("Round trip changed %v into %v", packet, roundTripped)
+		}
+	})
+}
+
+// Parsed options must survive a trip through MarshalOptions unchanged.
+func FuzzParseOptions(f *testing.F) {
+	f.Add([]byte("blksize\x001428\x00tsize\x000\x00"))
+	f.Add([]byte("multicast\x00\x00"))
+	f.Add([]byte("TIMEOUT\x005\x00timeout\x006\x00"))
+	f.Add([]byte("tsize\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		options, err := ParseOptions(data)
+		if err != nil {
+			return
+		}
+
+		for name := range options {
+			if name != strings.ToLower(name) {
+				t.Fatalf("Option %q was not lower-cased", name)
+			}
+		}
+
+		roundTripped, err := ParseOptions(MarshalOptions(options))
+		if err != nil || !reflect.DeepEqual(options, roundTripped) {
+			t.Fatalf("Round trip changed %v into %v (%v)", options, roundTripped, err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+// Pagestore.go stores the pages of files by their content, so identical pages are stored once however many
+// files they're in. Repeated uploads of the same firmware, or hundreds of near-identical configs, then cost
+// little more memory than one. Pages are addressed by their SHA-256 and counted, and a page is forgotten
+// once no file holds it. Files still hold their pages as plain []byte, so they're read as they always were;
+// the pages are shared, so they must never be modified.
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+type PageStore struct {
+	Pages        map[[sha256.Size]byte]*StoredPage
+	LogicalBytes int // The size of all the pages held by files, counting shared pages once per file.
+	StoredBytes  int // The size of all the distinct pages.
+	sync.Mutex       // Guards everything; pages are appended by sessions concurrently.
+}
+
+type StoredPage struct {
+	Data []byte
+	Refs int
+}
+
+func MakePageStore() *PageStore {
+	return &PageStore{Pages: make(map[[sha256.Size]byte]*StoredPage)}
+}
+
+// Returns the stored copy of the page, storing it if it's new. A nil PageStore just copies the page.
+func (s *PageStore) Intern(data []byte) []byte {
+	if s == nil {
+		page := make([]byte, len(data))
+		copy(page, data)
+		return page
+	}
+
+	key := sha256.Sum256(data)
+
+	s.Lock()
+	defer s.Unlock()
+
+	stored := s.Pages[key]
+	if stored == nil {
+		stored = &StoredPage{Data: make([]byte, len(data))}
+		copy(stored.Data, data)
+		s.Pages[key] = stored
+		s.StoredBytes += len(data)
+	}
+	stored.Refs++
+	s.LogicalBytes += len(data)
+	return stored.Data
+}
+
+// Lets go of the file's pages, forgetting those no other file holds.
+// Anybody still reading the file keeps its pages alive until they're done.
+func (s *PageStore) Release(file *File) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for element := file.Pages.Front(); element != nil; element = element.Next() {
+		page := element.Value.([]byte)
+		key := sha256.Sum256(page)
+
+		stored := s.Pages[key]
+		if stored == nil {
+			continue
+		}
+		stored.Refs--
+		s.LogicalBytes -= len(page)
+		if stored.Refs == 0 {
+			delete(s.Pages, key)
+			s.StoredBytes -= len(page)
+		}
+	}
+}
+
+type PageStats struct {
+	Pages        int     `json:"pages"`
+	LogicalBytes int     `json:"logicalBytes"`
+	StoredBytes  int     `json:"storedBytes"`
+	DedupRatio   float64 `json:"dedupRatio"` // LogicalBytes over StoredBytes; 1 if nothing is shared.
+}
+
+func (s *PageStore) Stats() PageStats {
+	s.Lock()
+	defer s.Unlock()
+
+	stats := PageStats{Pages: len(s.Pages), LogicalBytes: s.LogicalBytes, StoredBytes: s.StoredBytes, DedupRatio: 1}
+	if s.StoredBytes > 0 {
+		stats.DedupRatio = float64(s.LogicalBytes) / float64(s.StoredBytes)
+	}
+	return stats
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Identical pages are stored once, and forgotten once no file holds them.
+func TestPageDedup(t *testing.T) {
+	fs := MakeFileSystem()
+	firmware := MakeTestContent(1, 4*FullDataPayloadLength+100)
+	StoreTestFile(fs, "a", firmware)
+	StoreTestFile(fs, "b", firmware)
+	StoreTestFile(fs, "c", append(append([]byte{}, firmware[:FullDataPayloadLength]...), 'x'))
+
+	stats := fs.PageStore.Stats()
+	ErrorIf(t, stats.Pages != 6, "Expected the 5 firmware pages and the final \"x\"")
+	ErrorIf(t, stats.StoredBytes != len(firmware)+1, "Shared pages should be stored once")
+	ErrorIf(t, stats.LogicalBytes != 2*len(firmware)+FullDataPayloadLength+1, "Logical size wrong")
+	ErrorIf(t, stats.DedupRatio <= 2, "Dedup ratio wrong")
+
+	ErrorIf(t, ReadTestFile(fs, "b") != string(firmware), "Deduplicated file read wrong")
+	reader, _ := fs.GetReader("a")
+
+	fs.Delete("a")
+	fs.Delete("c")
+	ErrorIf(t, fs.PageStore.Stats().StoredBytes != len(firmware), "Pages still held by b should be kept")
+	fs.Delete("b")
+	ErrorIf(t, fs.PageStore.Stats() != PageStats{DedupRatio: 1}, "Pages held by no file should be forgotten")
+	ErrorIf(t, !bytes.Equal(reader.ReadBlock(), firmware[:FullDataPayloadLength]), "Readers should keep their pages")
+
+	// Abandoned uploads let go of their pages too.
+	ws := MakeWriteSession(fs)
+	Dispatch(ws, &WriteRequestPacket{RequestPacket{"partial", "octet", nil}})
+	Dispatch(ws, &DataPacket{1, firmware[:FullDataPayloadLength]})
+	ErrorIf(t, fs.PageStore.Stats().Pages != 1, "Uploads should store their pages as they go")
+	ws.Close()
+	ErrorIf(t, fs.PageStore.Stats().Pages != 0, "Abandoned uploads should let go of their pages")
+}
@@ -0,0 +1,206 @@
+// Provider.go lets reads be served from content generated on demand, like PXE menus and per-host configs,
+// rather than from files stored in the FileSystem. Generated content is streamed to the client block by block
+// and never committed to the store.
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Produces files on demand.
+type ContentProvider interface {
+	// Returns the content of the file for the client, or a nil reader if the provider doesn't have it.
+	// Returning an *ErrorPacket as the error sends that error to the client.
+	Provide(filename string, client *net.UDPAddr) (io.Reader, error)
+}
+
+// Lets ordinary functions be used as ContentProviders.
+type ContentProviderFunc func(filename string, client *net.UDPAddr) (io.Reader, error)
+
+func (f ContentProviderFunc) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	return f(filename, client)
+}
+
+// The providers consulted by ReadSessions.
+// Providers registered for a path prefix are consulted before the FileSystem, with the longest prefix first.
+// Fallback providers are consulted in order when neither has the file.
+type ContentProviders struct {
+	Prefixed  map[string]ContentProvider
+	Fallbacks []ContentProvider
+}
+
+func MakeContentProviders() *ContentProviders {
+	return &ContentProviders{Prefixed: make(map[string]ContentProvider)}
+}
+
+// Consults the provider for every file under the prefix before the FileSystem.
+func (p *ContentProviders) AddPrefix(prefix string, provider ContentProvider) {
+	p.Prefixed[prefix] = provider
+}
+
+// Consults the provider when nothing else has a file.
+func (p *ContentProviders) AddFallback(provider ContentProvider) {
+	p.Fallbacks = append(p.Fallbacks, provider)
+}
+
+// Opens a file for reading from wherever it can be found.
+// A nil ContentProviders only looks in the FileSystem.
+func (p *ContentProviders) Open(filename string, client *net.UDPAddr, fs *FileSystem) (BlockReader, *ErrorPacket) {
+	if p == nil {
+		return OpenStored(fs, filename)
+	}
+
+	if reader, err := p.openPrefixed(filename, client); reader != nil || err != nil {
+		return reader, err
+	}
+
+	reader, err := OpenStored(fs, filename)
+	if err == nil || err.ErrorCode != ERR_FILE_NOT_FOUND {
+		return reader, err
+	}
+
+	for _, provider := range p.Fallbacks {
+		reader, err := OpenProvided(provider, filename, client)
+		if reader != nil || err != nil {
+			return reader, err
+		}
+	}
+
+	return nil, err
+}
+
+// Asks the providers registered for prefixes of the filename for it, longest prefix first.
+// Both results are nil if none of them has it.
+func (p *ContentProviders) openPrefixed(filename string, client *net.UDPAddr) (BlockReader, *ErrorPacket) {
+	for _, prefix := range p.matchingPrefixes(filename) {
+		reader, err := OpenProvided(p.Prefixed[prefix], filename, client)
+		if reader != nil || err != nil {
+			return reader, err
+		}
+	}
+	return nil, nil
+}
+
+// Returns true if a provider registered for a prefix of the filename serves it to the client, or refuses it,
+// rather than leaving it to the FileSystem. What the provider generated is thrown away.
+func (p *ContentProviders) Overrides(filename string, client *net.UDPAddr) bool {
+	if p == nil {
+		return false
+	}
+
+	reader, err := p.openPrefixed(filename, client)
+	if closer, isCloser := reader.(io.Closer); isCloser {
+		closer.Close()
+	}
+	return reader != nil || err != nil
+}
+
+// Returns the prefixes of the filename that have providers, longest first.
+func (p *ContentProviders) matchingPrefixes(filename string) []string {
+	var prefixes []string
+	for prefix := range p.Prefixed {
+		if strings.HasPrefix(filename, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	return prefixes
+}
+
+func OpenStored(fs *FileSystem, filename string) (BlockReader, *ErrorPacket) {
+	reader, err := fs.GetReader(filename)
+	if err != nil {
+		if follower := fs.Follow(filename); follower != nil {
+			return follower, nil
+		}
+		// The upload may have been committed between the two, in which case it's stored now.
+		reader, err = fs.GetReader(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Asks a provider for a file. Both results are nil if it doesn't have it.
+func OpenProvided(provider ContentProvider, filename string, client *net.UDPAddr) (BlockReader, *ErrorPacket) {
+	stream, err := provider.Provide(filename, client)
+	if err != nil {
+		if errPacket, isErrPacket := err.(*ErrorPacket); isErrPacket {
+			return nil, errPacket
+		}
+		Log.Println("Failed to generate", filename, "due to", err)
+		return nil, &ErrorPacket{ERR_UNDEFINED, "Failed to generate file"}
+	}
+	if stream == nil {
+		return nil, nil
+	}
+
+	Log.Println("Began reading generated file", filename)
+	reader := &StreamReader{Stream: stream}
+	reader.AdvanceBlock()
+	return reader, nil
+}
+
+// Implemented by readers that may wait a long time, e.g. for an origin or for an upload they're following,
+// so that they can stop waiting when the transfer is aborted.
+type Stoppable interface {
+	// Stops waiting once cancel is closed.
+	StopOn(cancel <-chan struct{})
+}
+
+// Reads a stream of generated content block by block.
+// The current block is read as soon as the reader advances to it, so the reader always knows
+// whether it's at the end: only the last block is shorter than 512 bytes.
+type StreamReader struct {
+	Block   uint16
+	Stream  io.Reader
+	Current []byte
+	Failure error
+}
+
+func (r *StreamReader) GetBlock() uint16 {
+	return r.Block
+}
+
+func (r *StreamReader) ReadBlock() []byte {
+	return r.Current
+}
+
+func (r *StreamReader) AdvanceBlock() {
+	r.Block++
+	r.Current = make([]byte, FullDataPayloadLength)
+
+	bytesRead, err := io.ReadFull(r.Stream, r.Current)
+	r.Current = r.Current[:bytesRead]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.Failure = err
+	}
+}
+
+func (r *StreamReader) AtEnd() bool {
+	return len(r.Current) < FullDataPayloadLength
+}
+
+func (r *StreamReader) Err() error {
+	return r.Failure
+}
+
+// Passes cancel on to the stream, if it can wait a long time.
+func (r *StreamReader) StopOn(cancel <-chan struct{}) {
+	if stoppable, isStoppable := r.Stream.(Stoppable); isStoppable {
+		stoppable.StopOn(cancel)
+	}
+}
+
+// Closes the stream, if it can be closed, so that abandoned reads don't leave downloads or files open.
+func (r *StreamReader) Close() error {
+	if closer, isCloser := r.Stream.(io.Closer); isCloser {
+		return closer.Close()
+	}
+	return nil
+}
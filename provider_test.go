@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// Serves "menu-<ip>" for any file under menus/, and fails for anything under broken/.
+func MakeTestProviders() *ContentProviders {
+	providers := MakeContentProviders()
+	providers.AddPrefix("menus/", ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		return bytes.NewBufferString("menu-" + client.IP.String()), nil
+	}))
+	providers.AddPrefix("menus/denied/", ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		return nil, &ErrorPacket{ERR_ACCESS_VIOLATION, "Not for you"}
+	}))
+	providers.AddPrefix("broken/", ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		return nil, fmt.Errorf("Template exploded")
+	}))
+	providers.AddFallback(ContentProviderFunc(func(filename string, client *net.UDPAddr) (io.Reader, error) {
+		if filename != "big" {
+			return nil, nil
+		}
+		return bytes.NewReader(MakePaddedBytes("big")), nil
+	}))
+	return providers
+}
+
+type FailingReader struct{}
+
+func (r FailingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("Disk on fire")
+}
+
+func TestProvidedSession(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "menus/stored", []byte("stored"))
+	StoreTestFile(fs, "stored", []byte("stored"))
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: 1234}
+
+	MakeSession := func() *ReadSession {
+		rs := MakeReadSession(fs)
+		rs.RemoteAddr = client
+		rs.Providers = MakeTestProviders()
+		return rs
+	}
+
+	// Prefixed providers take precedence over the store.
+	rs := MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"menus/stored", "octet", nil}}, &DataPacket{1, []byte("menu-10.0.0.7")})
+	h.Verify(rs, &AckPacket{1}, nil)
+	h.VerifyDead(rs)
+
+	// Files outside any prefix come from the store.
+	rs = MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"stored", "octet", nil}}, &DataPacket{1, []byte("stored")})
+
+	// Fallbacks are used when the store misses. A file of exactly 512 bytes ends with an empty block.
+	rs = MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"big", "octet", nil}}, &DataPacket{1, MakePaddedBytes("big")})
+	h.Verify(rs, &AckPacket{1}, &DataPacket{2, []byte{}})
+	h.Verify(rs, &AckPacket{2}, nil)
+	h.VerifyDead(rs)
+
+	rs = MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"missing", "octet", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+
+	// The longest prefix wins, and providers can choose the error the client gets.
+	rs = MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"menus/denied/x", "octet", nil}}, &ErrorPacket{ERR_ACCESS_VIOLATION, "Not for you"})
+
+	rs = MakeSession()
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"broken/x", "octet", nil}}, &ErrorPacket{ERR_UNDEFINED, "Failed to generate file"})
+	h.VerifyDead(rs)
+}
+
+func TestStreamReader(t *testing.T) {
+	content := MakeTestContent(1, 2*FullDataPayloadLength+3)
+	reader, _ := OpenProvided(ContentProviderFunc(func(string, *net.UDPAddr) (io.Reader, error) {
+		return bytes.NewReader(content), nil
+	}), "foo", nil)
+
+	var read []byte
+	for {
+		read = append(read, reader.ReadBlock()...)
+		if reader.AtEnd() {
+			break
+		}
+		reader.AdvanceBlock()
+	}
+	ErrorIf(t, reader.GetBlock() != 3, "Expected 3 blocks")
+	ErrorIf(t, !bytes.Equal(read, content), "Stream read back wrong")
+
+	reader, _ = OpenProvided(ContentProviderFunc(func(string, *net.UDPAddr) (io.Reader, error) {
+		return FailingReader{}, nil
+	}), "foo", nil)
+	ErrorIf(t, reader.Err() == nil, "Read failure should be reported")
+}
+
+// Counts how often it's closed.
+type CountingCloser struct {
+	io.Reader
+	Closes int
+}
+
+func (c *CountingCloser) Close() error {
+	c.Closes++
+	return nil
+}
+
+// Reads abandoned part way through close what they were reading.
+func TestAbandonedStreamIsClosed(t *testing.T) {
+	h := TestHarness{t}
+	stream := &CountingCloser{Reader: bytes.NewReader(MakeTestContent(1, 3*FullDataPayloadLength))}
+	rs := MakeReadSession(MakeFileSystem())
+	rs.Providers = MakeContentProviders()
+	rs.Providers.AddFallback(ContentProviderFunc(func(string, *net.UDPAddr) (io.Reader, error) {
+		return &ClosingReader{Stream: stream}, nil
+	}))
+
+	reply := Dispatch(rs, &ReadRequestPacket{RequestPacket{"foo", "octet", nil}})
+	ErrorIf(t, reply.(*DataPacket).Block != 1, "Expected the first block")
+	rs.Close()
+	rs.Close()
+	ErrorIf(t, stream.Closes != 1, "Abandoned streams should be closed once")
+
+	// Sessions that never opened anything have nothing to close.
+	rs = MakeReadSession(MakeFileSystem())
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"missing", "octet", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+	rs.Close()
+}
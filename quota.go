@@ -0,0 +1,114 @@
+// Quota.go limits how much the in-memory FileSystem can hold, so a runaway upload can't exhaust our memory.
+// Uploads reserve space block by block as they're written, and give it back if they aren't committed.
+// Committed files hold their space until they're deleted.
+// There are three limits, any of which may be zero for no limit:
+// * The total size of all files, committed or still being uploaded.
+// * The size of any one file.
+// * The total size of the files uploaded by each client, by IP address.
+// If FileSystem.EvictLRU is set, the least recently used files are evicted to keep under the total size,
+// rather than uploads being refused.
+package main
+
+import (
+	"net"
+)
+
+type Quota struct {
+	MaxBytes       int
+	MaxFileBytes   int
+	MaxClientBytes int
+}
+
+// Space held by files, committed or still being uploaded.
+type Usage struct {
+	Bytes       int
+	StoredBytes int            // The part of Bytes held by committed files.
+	ClientBytes map[string]int // Keyed by IP address.
+}
+
+// Checks whether a file of the given size could be uploaded by the client, without reserving anything.
+// Lets an upload that's bound to fail be refused as soon as it's requested.
+func (f *FileSystem) CheckQuota(client string, size int) *ErrorPacket {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.checkQuota(client, 0, size, false)
+}
+
+// Reserves space for data about to be appended to a file being uploaded.
+func (f *FileSystem) Reserve(file *File, size int) *ErrorPacket {
+	f.Lock()
+	defer f.Unlock()
+
+	client := ClientOf(file)
+	if err := f.checkQuota(client, file.Size, size, true); err != nil {
+		return err
+	}
+
+	f.charge(file, size)
+	return nil
+}
+
+// Gives back the space held by a file that won't be committed, and throws away its data.
+func (f *FileSystem) Discard(file *File) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.charge(file, -file.Reserved)
+	f.unfollow(file, false) // Before the pages go, so followers stop reading them.
+	file.Store.Release(file)
+	file.Pages.Init()
+	file.Size = 0
+	Log.Println("Discarded file", file.Filename)
+}
+
+// Checks whether size more bytes can be added to a file of fileSize bytes, evicting files to make room if asked.
+// Must be called with the lock held.
+func (f *FileSystem) checkQuota(client string, fileSize int, size int, evict bool) *ErrorPacket {
+	switch {
+	case f.Quota.MaxFileBytes > 0 && fileSize+size > f.Quota.MaxFileBytes:
+		return &ErrorPacket{ERR_DISK_FULL, "File too large"}
+	case f.Quota.MaxClientBytes > 0 && client != "" && f.Usage.ClientBytes[client]+size > f.Quota.MaxClientBytes:
+		return &ErrorPacket{ERR_DISK_FULL, "Quota exceeded"}
+	case f.Quota.MaxBytes == 0 || f.Usage.Bytes+size <= f.Quota.MaxBytes:
+		return nil
+	}
+
+	// Only committed files can be evicted, so there's no point evicting any if the uploads alone don't fit.
+	if !f.EvictLRU || f.Usage.Bytes-f.Usage.StoredBytes+size > f.Quota.MaxBytes {
+		return &ErrorPacket{ERR_DISK_FULL, "Disk full"}
+	}
+
+	for evict && f.Usage.Bytes+size > f.Quota.MaxBytes {
+		file := f.Recent.Back().Value.(*File)
+		f.remove(file)
+		Log.Println("Evicted file", file.Filename)
+		f.notifyRemoved(file.Filename)
+	}
+	return nil
+}
+
+// Adds to the space held by the file. Must be called with the lock held.
+func (f *FileSystem) charge(file *File, size int) {
+	file.Reserved += size
+	f.Usage.Bytes += size
+
+	client := ClientOf(file)
+	if client == "" {
+		return
+	}
+
+	f.Usage.ClientBytes[client] += size
+	if f.Usage.ClientBytes[client] == 0 {
+		delete(f.Usage.ClientBytes, client)
+	}
+}
+
+// Returns the IP address of the file's uploader, or "" if it doesn't have one.
+func ClientOf(file *File) string {
+	host, _, err := net.SplitHostPort(file.Uploader)
+	if err != nil {
+		return ""
+	}
+	return host
+}
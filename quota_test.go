@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func MakeQuotaSession(fs *FileSystem, client string) *WriteSession {
+	ws := MakeWriteSession(fs)
+	ws.RemoteAddr = ParseRemoteAddr(client)
+	return ws
+}
+
+func TestFileQuota(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Quota.MaxFileBytes = 1000
+	block := MakeTestContent(1, FullDataPayloadLength)
+
+	ws := MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"big", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, block}, &AckPacket{1})
+	ErrorIf(t, fs.Usage.Bytes != FullDataPayloadLength, "Uploads should hold their space as they go")
+	h.Verify(ws, &DataPacket{2, block}, &ErrorPacket{ERR_DISK_FULL, "File too large"})
+	h.VerifyDead(ws)
+	ErrorIf(t, fs.Usage.Bytes != 0 || len(fs.Usage.ClientBytes) != 0, "Refused uploads should give back their space")
+	ErrorIf(t, ws.Writer.Pages.Len() != 0, "Refused uploads should be discarded")
+
+	// Clients that say how large the file is are refused straight away.
+	ws = MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"big", "octet", map[string]string{"tsize": "5000"}}}, &ErrorPacket{ERR_DISK_FULL, "File too large"})
+	ws = MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"small", "octet", map[string]string{"tsize": "500"}}}, &AckPacket{0})
+}
+
+func TestTotalQuota(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Quota.MaxBytes = 1024
+	StoreTestFile(fs, "existing", MakeTestContent(1, 600))
+	ErrorIf(t, fs.Usage.Bytes != 600, "Committed files should hold their space")
+
+	ws := MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"new", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(2, FullDataPayloadLength)}, &ErrorPacket{ERR_DISK_FULL, "Disk full"})
+
+	fs.Delete("existing")
+	ErrorIf(t, fs.Usage.Bytes != 0, "Deleted files should give back their space")
+
+	ws = MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"new", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(2, FullDataPayloadLength)}, &AckPacket{1})
+
+	// An upload that's abandoned gives back its space once its connection is done.
+	ws.Close()
+	ErrorIf(t, fs.Usage.Bytes != 0, "Abandoned uploads should give back their space")
+}
+
+func TestClientQuota(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	fs.Quota.MaxClientBytes = 600
+
+	ws := MakeQuotaSession(fs, "10.0.0.1:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"first", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, MakeTestContent(1, FullDataPayloadLength)}, &AckPacket{1})
+	h.Verify(ws, &DataPacket{2, []byte("end")}, &AckPacket{2})
+	ErrorIf(t, fs.Usage.ClientBytes["10.0.0.1"] != FullDataPayloadLength+3, "Client usage wrong")
+
+	// The quota is per IP address, whatever port the client uses.
+	ws = MakeQuotaSession(fs, "10.0.0.1:2000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"second", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, make([]byte, 100)}, &ErrorPacket{ERR_DISK_FULL, "Quota exceeded"})
+
+	ws = MakeQuotaSession(fs, "10.0.0.2:1000")
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"second", "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, make([]byte, 100)}, &AckPacket{1})
+
+	fs.Delete("first")
+	ErrorIf(t, fs.Usage.ClientBytes["10.0.0.1"] != 0, "Deleted files should give back the client's space")
+}
@@ -0,0 +1,256 @@
+// Remap.go rewrites requested filenames before they're looked up, in the style of tftp-hpa's -m option.
+// Devices ask for things like "\boot\pxelinux.0" or "/tftpboot/C0A80105", which never match the names
+// files are stored under, so a list of rules maps them onto the names we have.
+//
+// A rules file has one rule per line. Blank lines and lines starting with # are ignored.
+//
+//   <flags> <regex> [<replacement>]
+//
+// Flags (at least one is required):
+//   r  Replace the first match of regex with replacement, then carry on with the next rule.
+//   g  Like r, but replace every match.
+//   i  Match regex case-insensitively.
+//   e  Stop processing rules if this one matches.
+//   s  Start over from the first rule if this one matches.
+//   a  Refuse the request if this one matches.
+//   G  Only apply this rule to RRQs.
+//   P  Only apply this rule to WRQs.
+//
+// In the replacement, \0 is the whole match, \1 to \9 are the regex's groups, \i is the client's IP address,
+// \x is the client's IPv4 address as 8 upper-case hex digits (as PXELINUX asks for it), and \\ is a backslash.
+// An empty replacement may be written as "".
+//
+// Two more rules take no regex:
+//   lowercase   Lower-cases the whole filename.
+//   backslashes Turns every backslash into a forward slash.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Restarting ('s' rules) can loop forever with a bad rules file, so give up after this many.
+const MaxRemapRestarts = 32
+
+type RemapRule struct {
+	Pattern     *regexp.Regexp // Nil for lowercase and backslashes.
+	Replacement string
+	Lowercase   bool
+	Backslashes bool
+	Replace     bool
+	Global      bool
+	End         bool
+	Restart     bool
+	Deny        bool
+	ReadOnly    bool
+	WriteOnly   bool
+}
+
+type Remapper struct {
+	Rules []*RemapRule
+}
+
+func LoadRemapRules(path string) (*Remapper, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseRemapRules(file)
+}
+
+func ParseRemapRules(r io.Reader) (*Remapper, error) {
+	remapper := new(Remapper)
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule, err := ParseRemapRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		remapper.Rules = append(remapper.Rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return remapper, nil
+}
+
+func ParseRemapRule(fields []string) (*RemapRule, error) {
+	rule := new(RemapRule)
+
+	switch fields[0] {
+	case "lowercase":
+		rule.Lowercase = true
+		return rule, nil
+	case "backslashes":
+		rule.Backslashes = true
+		return rule, nil
+	}
+
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("Expected flags, regex and replacement")
+	}
+
+	caseInsensitive := false
+	for _, flag := range fields[0] {
+		switch flag {
+		case 'r':
+			rule.Replace = true
+		case 'g':
+			rule.Replace = true
+			rule.Global = true
+		case 'i':
+			caseInsensitive = true
+		case 'e':
+			rule.End = true
+		case 's':
+			rule.Restart = true
+		case 'a':
+			rule.Deny = true
+		case 'G':
+			rule.ReadOnly = true
+		case 'P':
+			rule.WriteOnly = true
+		default:
+			return nil, fmt.Errorf("Unknown flag %q", flag)
+		}
+	}
+
+	expr := fields[1]
+	if caseInsensitive {
+		expr = "(?i)" + expr
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	rule.Pattern = pattern
+
+	if len(fields) == 3 && fields[2] != `""` {
+		rule.Replacement = fields[2]
+	}
+
+	return rule, nil
+}
+
+// Rewrites the filename of an RRQ or WRQ (given by opcode) from the client.
+// A nil Remapper leaves filenames alone. An error means a rule refused the request.
+func (m *Remapper) Remap(filename string, opcode uint16, client net.IP) (string, error) {
+	if m == nil {
+		return filename, nil
+	}
+
+	restarts := 0
+
+rules:
+	for index := 0; index < len(m.Rules); index++ {
+		rule := m.Rules[index]
+
+		if (rule.ReadOnly && opcode != PKT_RRQ) || (rule.WriteOnly && opcode != PKT_WRQ) {
+			continue
+		}
+
+		switch {
+		case rule.Lowercase:
+			filename = strings.ToLower(filename)
+			continue rules
+		case rule.Backslashes:
+			filename = strings.Replace(filename, `\`, "/", -1)
+			continue rules
+		}
+
+		if !rule.Pattern.MatchString(filename) {
+			continue
+		}
+
+		if rule.Deny {
+			return "", fmt.Errorf("Access denied")
+		}
+
+		if rule.Replace {
+			filename = rule.Apply(filename, client)
+		}
+
+		if rule.End {
+			break
+		}
+
+		if rule.Restart {
+			restarts++
+			if restarts > MaxRemapRestarts {
+				return "", fmt.Errorf("Too many restarts remapping filename")
+			}
+			index = -1
+		}
+	}
+
+	return filename, nil
+}
+
+// Replaces the first (or with the g flag, every) match of the rule's pattern in the filename.
+func (rule *RemapRule) Apply(filename string, client net.IP) string {
+	limit := 1
+	if rule.Global {
+		limit = -1
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, match := range rule.Pattern.FindAllStringSubmatchIndex(filename, limit) {
+		result.WriteString(filename[last:match[0]])
+		result.WriteString(ExpandReplacement(rule.Replacement, filename, match, client))
+		last = match[1]
+	}
+	result.WriteString(filename[last:])
+
+	return result.String()
+}
+
+// Expands the backslash escapes of a replacement for one match.
+func ExpandReplacement(replacement string, filename string, match []int, client net.IP) string {
+	var result strings.Builder
+
+	for i := 0; i < len(replacement); i++ {
+		if replacement[i] != '\\' || i+1 == len(replacement) {
+			result.WriteByte(replacement[i])
+			continue
+		}
+
+		i++
+		escape := replacement[i]
+		switch {
+		case escape >= '0' && escape <= '9':
+			group := int(escape - '0')
+			if 2*group+1 < len(match) && match[2*group] >= 0 {
+				result.WriteString(filename[match[2*group]:match[2*group+1]])
+			}
+		case escape == 'i':
+			if client != nil {
+				result.WriteString(client.String())
+			}
+		case escape == 'x':
+			if ip := client.To4(); ip != nil {
+				result.WriteString(fmt.Sprintf("%02X%02X%02X%02X", ip[0], ip[1], ip[2], ip[3]))
+			}
+		default:
+			result.WriteByte(escape)
+		}
+	}
+
+	return result.String()
+}
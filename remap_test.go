@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+type RemapTestCase struct {
+	Filename string
+	Opcode   uint16
+	Expected string // Empty if the request should be denied.
+}
+
+const TestRemapRules = `
+# Windows clients use backslashes.
+backslashes
+lowercase
+
+# Strip the TFTP root that some devices prepend.
+r  ^/tftpboot/  ""
+r  ^/           ""
+
+# PXELINUX config by IP address goes to the per-host directory.
+rG ^pxelinux\.cfg/([0-9A-F]{8})$  hosts/\1.cfg
+# ...and the generic config is picked by the client's own IP.
+reG ^pxelinux\.cfg/default$        hosts/\x.cfg
+
+# Uploads land in a per-client directory.
+rP ^(.*)$  uploads/\i/\1
+
+ai \.\./
+`
+
+func TestRemap(t *testing.T) {
+	remapper, err := ParseRemapRules(strings.NewReader(TestRemapRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("192.168.1.5")
+
+	tests := []RemapTestCase{
+		{`\Boot\PXELINUX.0`, PKT_RRQ, "boot/pxelinux.0"},
+		{"/tftpboot/pxelinux.0", PKT_RRQ, "pxelinux.0"},
+		{"/pxelinux.0", PKT_RRQ, "pxelinux.0"},
+		// Lower-casing happens before the PXELINUX rule, so its hex has to be upper-case again.
+		{"pxelinux.cfg/default", PKT_RRQ, "hosts/C0A80105.cfg"},
+		{"router-confg", PKT_WRQ, "uploads/192.168.1.5/router-confg"},
+		{"router-confg", PKT_RRQ, "router-confg"},
+		{"../etc/passwd", PKT_RRQ, ""},
+	}
+
+	for k, test := range tests {
+		mapped, err := remapper.Remap(test.Filename, test.Opcode, client)
+		if test.Expected == "" {
+			if err == nil {
+				t.Fatalf("Test %d failed: %q should have been denied, got %q", k, test.Filename, mapped)
+			}
+			continue
+		}
+		if err != nil || mapped != test.Expected {
+			t.Fatalf("Test %d failed: %q mapped to %q (%v), expected %q", k, test.Filename, mapped, err, test.Expected)
+		}
+	}
+}
+
+func TestRemapGroupsAndGlobal(t *testing.T) {
+	remapper, err := ParseRemapRules(strings.NewReader(`
+g  -  _
+r  ^([a-z]+)_([a-z]+)$  \2_\1\\
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, _ := remapper.Remap("foo-bar", PKT_RRQ, nil)
+	ErrorIf(t, mapped != `bar_foo\`, "Expected groups to be swapped, got "+mapped)
+}
+
+// A restart that always matches must not hang the server.
+func TestRemapRestartLimit(t *testing.T) {
+	remapper, _ := ParseRemapRules(strings.NewReader("rs a a"))
+	_, err := remapper.Remap("a", PKT_RRQ, nil)
+	ErrorIf(t, err == nil, "Endless restarts should fail")
+}
+
+func TestRemapBadRules(t *testing.T) {
+	for _, rules := range []string{"x foo bar", "r ( bar", "r", "r a b c"} {
+		_, err := ParseRemapRules(strings.NewReader(rules))
+		ErrorIf(t, err == nil, "Rules should not parse: "+rules)
+	}
+}
+
+func TestNilRemapper(t *testing.T) {
+	var remapper *Remapper
+	mapped, err := remapper.Remap("foo", PKT_RRQ, nil)
+	ErrorIf(t, err != nil || mapped != "foo", "A nil Remapper should leave filenames alone")
+}
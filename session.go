@@ -2,7 +2,13 @@
 // packets to sessions.
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+)
 
 // Sessions stay alive as long as the connection hasn't completed or terminated abnormally.
 type SessionKiller interface {
@@ -10,6 +16,8 @@ type SessionKiller interface {
 	WantsToDie() bool
 	// Forces the session to signal its termination.
 	MakeWantToDie()
+	// Asks the connection layer to linger after termination, in case our last reply was lost.
+	WantsToDally() bool
 }
 
 // This interface bridges the connection layer with the session layer.
@@ -21,6 +29,8 @@ type PacketHandler interface {
 	ProcessData(p *DataPacket) Packet
 	ProcessAck(p *AckPacket) Packet
 	ProcessError(p *ErrorPacket) Packet
+	// Releases whatever the session holds, once the connection is done with it.
+	Close()
 	SessionKiller
 }
 
@@ -28,8 +38,13 @@ type PacketHandler interface {
 // There are two (embedded) types of Sessions: ReadSession (for RRQ) and WriteSession (for WRQ.)
 // The PacketHandler interface methods mutate the session's state, and return packets to be delivered to the remote host.
 type Session struct {
-	ShouldDie bool
-	Fs        *FileSystem
+	ShouldDie   bool
+	ShouldDally bool
+	Fs          *FileSystem
+	RemoteAddr  *net.UDPAddr    // Nil if the session isn't backed by a connection, e.g. in tests.
+	Remap       *Remapper       // Nil if filenames aren't remapped.
+	Filename    string          // The file being transferred, once the request has been accepted.
+	Cancel      <-chan struct{} // Closed when the transfer is aborted, so the session stops waiting. Nil if it can't be.
 }
 
 func (s *Session) WantsToDie() bool {
@@ -40,19 +55,48 @@ func (s *Session) MakeWantToDie() {
 	s.ShouldDie = true
 }
 
+func (s *Session) WantsToDally() bool {
+	return s.ShouldDally
+}
+
+// Applies the remapping rules to the filename of an RRQ or WRQ (given by opcode.)
+func (s *Session) MapFilename(filename string, opcode uint16) (string, *ErrorPacket) {
+	var client net.IP
+	if s.RemoteAddr != nil {
+		client = s.RemoteAddr.IP
+	}
+
+	mapped, err := s.Remap.Remap(filename, opcode, client)
+	if err != nil {
+		return "", &ErrorPacket{ERR_ACCESS_VIOLATION, err.Error()}
+	}
+	if mapped != filename {
+		Log.Println("Remapped", filename, "to", mapped)
+	}
+
+	return mapped, nil
+}
+
 func (s *Session) ProcessError(packet *ErrorPacket) Packet {
 	s.ShouldDie = true
 	return nil
 }
 
+func (s *Session) Close() {
+}
+
 // Write Session (WRQ)
 type WriteSession struct {
 	Session
-	Writer *File
+	Writer    *File
+	Committed bool
+	Closed    bool
+	Failure   *ErrorPacket         // Why the upload failed, if it did.
+	Hashes    map[string]hash.Hash // Checksums of the upload so far, keyed by algorithm.
 }
 
 func MakeWriteSession(fs *FileSystem) *WriteSession {
-	return &WriteSession{Session{false, fs}, nil}
+	return &WriteSession{Session: Session{Fs: fs}}
 }
 
 func (s *WriteSession) ProcessRead(packet *ReadRequestPacket) Packet {
@@ -60,15 +104,47 @@ func (s *WriteSession) ProcessRead(packet *ReadRequestPacket) Packet {
 }
 
 func (s *WriteSession) ProcessWrite(packet *WriteRequestPacket) Packet {
-	var err *ErrorPacket
-	s.Writer, err = s.Fs.CreateFile(packet.Filename)
+	filename, err := s.MapFilename(packet.Filename, PKT_WRQ)
 	if err != nil {
 		return err
 	}
+
+	var client string
+	if s.RemoteAddr != nil {
+		client = s.RemoteAddr.IP.String()
+	}
+
+	// If the client tells us how large the file is (RFC 2349), don't wait for it to run out of space.
+	if tsize, parseErr := strconv.Atoi(packet.Options["tsize"]); parseErr == nil {
+		if err := s.Fs.CheckQuota(client, tsize); err != nil {
+			return err
+		}
+	}
+
+	s.Writer, err = s.Fs.CreateFile(filename)
+	if err != nil {
+		return err
+	}
+	if s.RemoteAddr != nil {
+		s.Writer.Uploader = s.RemoteAddr.String()
+	}
+	s.Filename = filename
+	s.Hashes = s.Fs.Integrity.NewHashes()
 	return &AckPacket{0}
 }
 
 func (s *WriteSession) ProcessData(packet *DataPacket) Packet {
+	// DATA can't come before the WRQ has been accepted.
+	if s.Writer == nil {
+		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Bad packet")
+	}
+
+	// The final ACK isn't re-sent on timeout, since the remote host doesn't acknowledge it.
+	// If the final DATA shows up again while we're dallying, our ACK was lost, so send another.
+	if s.ShouldDally && s.Writer.GetNumBlocks() == packet.Block {
+		return &AckPacket{packet.Block}
+	}
+
 	// Ignore duplicated DATA packets.
 	if s.Writer.GetNumBlocks() >= packet.Block {
 		return nil
@@ -81,17 +157,34 @@ func (s *WriteSession) ProcessData(packet *DataPacket) Packet {
 		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Out of order")
 	}
 
+	if err := s.Fs.Reserve(s.Writer, len(packet.Data)); err != nil {
+		s.Failure = err
+		s.Close()
+		return err
+	}
 	s.Writer.Append(packet.Data)
+	for _, h := range s.Hashes {
+		h.Write(packet.Data)
+	}
 
 	// If a DATA packet is less than the maximum length, then it must be the last packet.
 	if len(packet.Data) < FullDataPayloadLength {
+		s.Writer.Checksums = SumHashes(s.Hashes)
+
 		// We may fail to commit if another write session won a race to write the same file.
 		// But whether successful or unsuccessful, we should die now.
-		err := s.Fs.Commit(s.Writer)
+		err := s.Fs.Validators.Validate(s.Writer)
+		if err == nil {
+			err = s.Fs.Commit(s.Writer)
+		}
 		s.ShouldDie = true
 		if err != nil {
+			s.Failure = err
+			s.Close()
 			return err
 		}
+		s.Committed = true
+		s.ShouldDally = true
 	}
 
 	return &AckPacket{s.Writer.GetNumBlocks()}
@@ -101,26 +194,58 @@ func (s *WriteSession) ProcessAck(packet *AckPacket) Packet {
 	return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Bad packet")
 }
 
+// An upload that ends without being committed gives back its space, and raises a failed or aborted event.
+func (s *WriteSession) Close() {
+	if s.Writer == nil || s.Committed || s.Closed {
+		return
+	}
+	s.Closed = true
+
+	event := MakeHookEvent(HookAborted, s.Writer)
+	if s.Failure != nil {
+		event.Event, event.Error = HookFailed, s.Failure.Error()
+	}
+	s.Fs.Discard(s.Writer)
+	s.Fs.Hooks.Notify(event)
+}
+
 // Read Session (RRQ)
 type ReadSession struct {
 	Session
-	Reader *FileReader
+	Reader    BlockReader
+	Providers *ContentProviders // Nil if all files come from the FileSystem.
 }
 
 func MakeReadSession(fs *FileSystem) *ReadSession {
-	return &ReadSession{Session{false, fs}, nil}
+	return &ReadSession{Session: Session{Fs: fs}}
 }
 
 func (s *ReadSession) ProcessRead(packet *ReadRequestPacket) Packet {
-	reader, err := s.Fs.GetReader(packet.Filename)
+	filename, err := s.MapFilename(packet.Filename, PKT_RRQ)
 	if err != nil {
 		return err
 	}
 
+	reader, err := s.Providers.Open(filename, s.RemoteAddr, s.Fs)
+	if err != nil {
+		return err
+	}
+	if stoppable, isStoppable := reader.(Stoppable); isStoppable {
+		stoppable.StopOn(s.Cancel)
+	}
+
 	s.Reader = reader
+	s.Filename = filename
 	return MakeDataReply(s) // RRQ is acknowledged by sending DATA block 1.
 }
 
+// Releases the file being read, which for generated files may be a download or an open file.
+func (s *ReadSession) Close() {
+	if closer, isCloser := s.Reader.(io.Closer); isCloser {
+		closer.Close()
+	}
+}
+
 func (s *ReadSession) ProcessWrite(packet *WriteRequestPacket) Packet {
 	return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Bad packet")
 }
@@ -130,13 +255,18 @@ func (s *ReadSession) ProcessData(packet *DataPacket) Packet {
 }
 
 func (s *ReadSession) ProcessAck(packet *AckPacket) Packet {
+	// ACKs can't come before the RRQ has been accepted.
+	if s.Reader == nil {
+		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Bad packet")
+	}
+
 	// Duplicate or outdated ACKs can be explained by the network, and shouldn't cause error.
-	if packet.Block < s.Reader.Block {
+	if packet.Block < s.Reader.GetBlock() {
 		return nil
 	}
 
 	// Due to lock-step, this condition is impossible if the remote host is following the protocol.
-	if packet.Block > s.Reader.Block {
+	if packet.Block > s.Reader.GetBlock() {
 		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Out of order")
 	}
 
@@ -152,8 +282,14 @@ func (s *ReadSession) ProcessAck(packet *AckPacket) Packet {
 	return MakeDataReply(s)
 }
 
+// Generated files can fail part way through, in which case the transfer is aborted.
 func MakeDataReply(s *ReadSession) Packet {
-	return &DataPacket{s.Reader.Block, s.Reader.ReadBlock()}
+	if err := s.Reader.Err(); err != nil {
+		Log.Println("Failed to read file due to", err)
+		return MakeErrorReply(ERR_UNDEFINED, "Failed to read file")
+	}
+
+	return &DataPacket{s.Reader.GetBlock(), s.Reader.ReadBlock()}
 }
 
 func MakeErrorReply(errCode uint16, msg string) Packet {
@@ -174,6 +310,9 @@ func DispatchInner(s PacketHandler, packet Packet) Packet {
 		return s.ProcessAck(p)
 	case *ErrorPacket:
 		return s.ProcessError(p)
+	case *OptionAckPacket:
+		// Only servers send OACKs, and we're the server.
+		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Bad packet")
 	default:
 		panic(fmt.Errorf("Unknown packet type."))
 	}
@@ -198,13 +337,36 @@ func Dispatch(s PacketHandler, packet Packet) Packet {
 	return reply
 }
 
+// Maps a packet that failed to decode to the ERROR reply describing why.
+// Malformed ERROR packets get no reply, since ERROR packets are never acknowledged.
+func MakeDecodeErrorReply(err error) Packet {
+	decodeErr, isDecodeErr := err.(*DecodeError)
+	if !isDecodeErr {
+		return MakeErrorReply(ERR_ILLEGAL_OPERATION, "Error parsing packet")
+	}
+
+	if decodeErr.Opcode == PKT_ERROR {
+		return nil
+	}
+
+	return MakeErrorReply(ERR_ILLEGAL_OPERATION, decodeErr.Error())
+}
+
 // Given raw request packet data, returns raw reply data (or nil if no response is given.)
 func ProcessPacket(s PacketHandler, requestPacket []byte) (marshalled []byte) {
-	unmarshalled, _ := UnmarshalPacket(requestPacket)
+	var reply Packet
 
-	Log.Println("Received", unmarshalled)
+	unmarshalled, err := UnmarshalPacket(requestPacket)
+	if err != nil {
+		Log.Println("Received malformed packet:", err)
 
-	reply := Dispatch(s, unmarshalled)
+		// A packet we can't make sense of can't be explained by the network, so it ends the session.
+		reply = MakeDecodeErrorReply(err)
+		s.MakeWantToDie()
+	} else {
+		Log.Println("Received", unmarshalled)
+		reply = Dispatch(s, unmarshalled)
+	}
 
 	Log.Println("Sent", reply)
 
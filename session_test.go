@@ -4,6 +4,7 @@ package main
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -24,6 +25,20 @@ func (h *TestHarness) Verify(session PacketHandler, request, expectedReply Packe
 	}
 }
 
+// Like Verify, but for packets that arrive while the connection dallies after the session is dead.
+func (h *TestHarness) VerifyDally(session PacketHandler, request, expectedReply Packet) {
+	h.t.Log("Dally request:", request, "expected reply:", expectedReply)
+	if !session.WantsToDally() {
+		h.t.Fatal("Session should have wanted to dally")
+	}
+
+	reply := Dispatch(session, request)
+
+	if !reflect.DeepEqual(expectedReply, reply) {
+		h.t.Fatal("Received unexpected reply. Expected:", expectedReply, reflect.TypeOf(expectedReply), "actual:", reply, reflect.TypeOf(reply))
+	}
+}
+
 func (h *TestHarness) VerifyDead(session PacketHandler) {
 	if !session.WantsToDie() {
 		h.t.Fatal("Session should have wanted to die.")
@@ -37,12 +52,12 @@ func TestSimpleReadWriteSession(t *testing.T) {
 	ws := MakeWriteSession(fs)
 	rs := MakeReadSession(fs)
 
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hello")}, &AckPacket{1})
 	h.Verify(ws, &DataPacket{2, []byte("world!")}, &AckPacket{2})
 	h.VerifyDead(ws)
 
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &DataPacket{1, MakePaddedBytes("hello")})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hello")})
 	h.Verify(rs, &AckPacket{1}, &DataPacket{2, []byte("world!")})
 	h.Verify(rs, &AckPacket{2}, nil)
 	h.VerifyDead(rs)
@@ -55,11 +70,11 @@ func TestSmallFile(t *testing.T) {
 	ws := MakeWriteSession(fs)
 	rs := MakeReadSession(fs)
 
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws, &DataPacket{1, []byte("world!")}, &AckPacket{1})
 	h.VerifyDead(ws)
 
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &DataPacket{1, []byte("world!")})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &DataPacket{1, []byte("world!")})
 	h.Verify(rs, &AckPacket{1}, nil)
 	h.VerifyDead(rs)
 }
@@ -74,12 +89,13 @@ func TestConcurrentWritesToSameFile(t *testing.T) {
 	ws1 := MakeWriteSession(fs)
 	ws2 := MakeWriteSession(fs)
 
-	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
-	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
+	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws1, &DataPacket{1, []byte("test")}, &AckPacket{1}) // Now ws1 has committed.
 	h.VerifyDead(ws1)
 	h.Verify(ws2, &DataPacket{1, []byte("test")}, &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}) // Now ws2 is turned away.
 	h.VerifyDead(ws2)
+	ErrorIf(t, ws2.WantsToDally(), "A failed upload should not dally")
 }
 
 // If the file has already been committed we should immediately turn it away.
@@ -89,10 +105,10 @@ func TestSerialWritesToSameFile(t *testing.T) {
 	ws1 := MakeWriteSession(fs)
 	ws2 := MakeWriteSession(fs)
 
-	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws1, &DataPacket{1, []byte("test")}, &AckPacket{1}) // Now ws1 has committed.
 	h.VerifyDead(ws1)
-	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}) // ws2 is turned away immediately.
+	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &ErrorPacket{ERR_FILE_ALREADY_EXISTS, ""}) // ws2 is turned away immediately.
 	h.VerifyDead(ws2)
 }
 
@@ -103,13 +119,14 @@ func TestDuplicatePacket(t *testing.T) {
 	ws := MakeWriteSession(fs)
 	rs := MakeReadSession(fs)
 
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0}) // Duplicate RRQ/WRQ shouldn't happen since those go to port 69.
-	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hi")}, &AckPacket{1})              // If it's < 512 bytes, the session will be dead and we won't re-transmit.
-	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hi")}, nil)                        // We'll re-transmit the last packet (which must have been an ACK.)
-	h.Verify(ws, &DataPacket{2, []byte("there")}, &AckPacket{2})                    // Duplicates of the last ACK packet can't come because we've spun down the listener.
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0}) // Duplicate RRQ/WRQ shouldn't happen since those go to port 69.
+	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hi")}, &AckPacket{1})                   // If it's < 512 bytes, the session will be dead and we won't re-transmit.
+	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hi")}, nil)                             // We'll re-transmit the last packet (which must have been an ACK.)
+	h.Verify(ws, &DataPacket{2, []byte("there")}, &AckPacket{2})
 	h.VerifyDead(ws)
+	h.VerifyDally(ws, &DataPacket{2, []byte("there")}, &AckPacket{2}) // If the last ACK is lost, it's re-sent while the connection dallies.
 
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &DataPacket{1, MakePaddedBytes("hi")})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hi")})
 	h.Verify(rs, &AckPacket{1}, &DataPacket{2, []byte("there")})
 	h.Verify(rs, &AckPacket{1}, nil) // Don't acknowledge duplicate ACKs.
 	h.Verify(rs, &AckPacket{2}, nil)
@@ -127,14 +144,14 @@ func TestInterleavedReadsAndWrites(t *testing.T) {
 	// ws1 and ws2 will interleaved-ly write foo1 and foo2.
 	// ws1 will commit, and then rs1 and rs2 will both read foo1.
 
-	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo1", "octal"}}, &AckPacket{0})
+	h.Verify(ws1, &WriteRequestPacket{RequestPacket{"foo1", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws1, &DataPacket{1, MakePaddedBytes("hi")}, &AckPacket{1})
-	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo2", "octal"}}, &AckPacket{0})
+	h.Verify(ws2, &WriteRequestPacket{RequestPacket{"foo2", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws2, &DataPacket{1, MakePaddedBytes("hi")}, &AckPacket{1})
 	h.Verify(ws1, &DataPacket{2, []byte("there")}, &AckPacket{2}) // Now ws1 has committed.
 	h.VerifyDead(ws1)
-	h.Verify(rs1, &ReadRequestPacket{RequestPacket{"foo1", "octal"}}, &DataPacket{1, MakePaddedBytes("hi")})
-	h.Verify(rs2, &ReadRequestPacket{RequestPacket{"foo1", "octal"}}, &DataPacket{1, MakePaddedBytes("hi")})
+	h.Verify(rs1, &ReadRequestPacket{RequestPacket{"foo1", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hi")})
+	h.Verify(rs2, &ReadRequestPacket{RequestPacket{"foo1", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hi")})
 	h.Verify(ws2, &DataPacket{2, []byte("there")}, &AckPacket{2}) // Now ws2 has committed.
 	h.VerifyDead(ws2)
 	h.Verify(rs1, &AckPacket{1}, &DataPacket{2, []byte("there")})
@@ -160,7 +177,7 @@ func TestErrorConditions(t *testing.T) {
 
 	// File not found.
 	rs := MakeReadSession(fs)
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &ErrorPacket{ERR_FILE_NOT_FOUND, ""})
 	h.VerifyDead(rs)
 
 	// Type 2: Receiving packet which cannot be explained.
@@ -170,40 +187,122 @@ func TestErrorConditions(t *testing.T) {
 	h.Verify(rs, nil, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Error parsing packet"})
 	h.VerifyDead(rs)
 
-	// Out-of-order packets: WRQ
+	// Malformed packets get a reply saying what was wrong with them.
+	rs = MakeReadSession(fs)
+	reply := ProcessPacket(rs, []byte{0, 9, 'x'})
+	ErrorIf(t, !reflect.DeepEqual(reply, MarshalPacket(&ErrorPacket{ERR_ILLEGAL_OPERATION, "Unknown opcode 9"})), "Expected unknown opcode error")
+	h.VerifyDead(rs)
+
+	// Except for malformed ERROR packets, since ERROR packets are never acknowledged.
+	rs = MakeReadSession(fs)
+	reply = ProcessPacket(rs, []byte{0, PKT_ERROR, 0, 1})
+	ErrorIf(t, reply != nil, "Malformed ERROR packet should not be answered")
+	h.VerifyDead(rs)
+
+	// Packets that come before the request.
+	rs = MakeReadSession(fs)
+	h.Verify(rs, &AckPacket{1}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Bad packet"})
+	h.VerifyDead(rs)
 	ws := MakeWriteSession(fs)
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("hi")}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Bad packet"})
+	h.VerifyDead(ws)
+
+	// Out-of-order packets: WRQ
+	ws = MakeWriteSession(fs)
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws, &DataPacket{2, MakePaddedBytes("hi")}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Out of order"})
 	h.VerifyDead(ws)
 
 	// Add 'foo' to the filesystem for the next test.
 	ws = MakeWriteSession(fs)
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal"}}, &AckPacket{0})
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws, &DataPacket{1, MakePaddedBytes("hello")}, &AckPacket{1})
 	h.Verify(ws, &DataPacket{2, []byte("world!")}, &AckPacket{2})
 	h.VerifyDead(ws)
 
 	// Out-of-order packets: RRQ
 	rs = MakeReadSession(fs)
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &DataPacket{1, MakePaddedBytes("hello")})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hello")})
 	h.Verify(rs, &AckPacket{2}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Out of order"})
 	h.VerifyDead(rs)
 
 	// Wrong type of packet: RRQ
 	rs = MakeReadSession(fs)
-	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal"}}, &DataPacket{1, MakePaddedBytes("hello")})
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"foo", "octal", nil}}, &DataPacket{1, MakePaddedBytes("hello")})
 	h.Verify(rs, &DataPacket{1, nil}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Bad packet"})
 	h.VerifyDead(rs)
 
 	// Wrong type of packet: WRQ
 	ws = MakeWriteSession(fs)
-	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo2", "octal"}}, &AckPacket{0})
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{"foo2", "octal", nil}}, &AckPacket{0})
 	h.Verify(ws, &AckPacket{0}, &ErrorPacket{ERR_ILLEGAL_OPERATION, "Bad packet"})
 	h.VerifyDead(ws)
 }
 
+// Feeds a request followed by two arbitrary packets to fresh read and write sessions.
+// Sessions must never panic, and every reply must itself be a well-formed packet.
+func FuzzProcessPacket(f *testing.F) {
+	f.Add([]byte{0, PKT_RRQ, 'f', 'o', 'o', 0, 'o', 'c', 't', 'e', 't', 0}, []byte{0, PKT_ACK, 0, 1}, []byte{0, PKT_ACK, 0, 2})
+	f.Add([]byte{0, PKT_WRQ, 'b', 'a', 'r', 0, 'o', 'c', 't', 'e', 't', 0}, []byte{0, PKT_DATA, 0, 1, 'h', 'i'}, []byte{0, PKT_DATA, 0, 1, 'h', 'i'})
+	f.Add([]byte{0, PKT_RRQ, 'f', 'o', 'o', 0, 'o', 'c', 't', 'e', 't', 0}, []byte{0, PKT_ERROR, 0, 0, 0}, []byte{0, 9})
+	f.Add([]byte{0, PKT_DATA, 0, 1}, []byte{0, PKT_ACK, 0, 0}, []byte{})
+
+	f.Fuzz(func(t *testing.T, request, first, second []byte) {
+		fs := MakeFileSystem()
+		file, _ := fs.CreateFile("foo")
+		file.Append(MakePaddedBytes("hello"))
+		file.Append([]byte("world"))
+		fs.Commit(file)
+
+		for _, session := range []PacketHandler{MakeReadSession(fs), MakeWriteSession(fs)} {
+			for _, packet := range [][]byte{request, first, second} {
+				if session.WantsToDie() && !session.WantsToDally() {
+					break
+				}
+
+				reply := ProcessPacket(session, packet)
+				if reply == nil {
+					continue
+				}
+
+				decoded, err := UnmarshalPacket(reply)
+				if err != nil {
+					t.Fatalf("Reply %v to %v is malformed: %v", reply, packet, err)
+				}
+				if _, isError := decoded.(*ErrorPacket); isError && !session.WantsToDie() {
+					t.Fatalf("Session survived sending %v", decoded)
+				}
+			}
+		}
+	})
+}
+
 func MakePaddedBytes(text string) []byte {
 	result := make([]byte, 512)
 	copy(result, text[:])
 	return result
 }
+
+// Requested filenames are remapped before they're looked up.
+func TestRemappedSession(t *testing.T) {
+	h := TestHarness{t}
+	fs := MakeFileSystem()
+	remapper, _ := ParseRemapRules(strings.NewReader("backslashes\nlowercase\nai secret"))
+
+	ws := MakeWriteSession(fs)
+	ws.Remap = remapper
+	h.Verify(ws, &WriteRequestPacket{RequestPacket{`Boot\Foo`, "octet", nil}}, &AckPacket{0})
+	h.Verify(ws, &DataPacket{1, []byte("hi")}, &AckPacket{1})
+
+	rs := MakeReadSession(fs)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"boot/foo", "octet", nil}}, &DataPacket{1, []byte("hi")})
+
+	rs = MakeReadSession(fs)
+	rs.Remap = remapper
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{`BOOT\FOO`, "octet", nil}}, &DataPacket{1, []byte("hi")})
+
+	rs = MakeReadSession(fs)
+	rs.Remap = remapper
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"secret", "octet", nil}}, &ErrorPacket{ERR_ACCESS_VIOLATION, "Access denied"})
+	h.VerifyDead(rs)
+}
@@ -0,0 +1,350 @@
+// Simulates transfers over a network that loses and duplicates packets.
+// The loss happens inside the simulated client: packets it "sends" may never leave, or leave twice,
+// and packets it receives may be discarded as if they never arrived. The server is a real Connection
+// talking real UDP, so these tests exercise connection.go's retransmission bookkeeping.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// A TFTP client on a bad network.
+type SimulatedClient struct {
+	conn        *net.UDPConn
+	sessionAddr *net.UDPAddr
+	rng         *rand.Rand
+
+	DropRate      float64       // Chance of any packet, in either direction, being lost.
+	DuplicateRate float64       // Chance of a sent packet being delivered twice.
+	Timeout       time.Duration // How long to wait for a reply before re-sending.
+	MaxRetries    int
+
+	// Set if the server sent the same DATA block twice without waiting for its own timeout,
+	// which is the symptom of the Sorcerer's Apprentice syndrome.
+	ApprenticeBlock uint16
+	lastDataSeen    map[uint16]time.Time
+	serverTimeout   time.Duration
+}
+
+func MakeSimulatedClient(seed int64, serverTimeout time.Duration) *SimulatedClient {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		panic(err)
+	}
+
+	return &SimulatedClient{
+		conn:          conn,
+		rng:           rand.New(rand.NewSource(seed)),
+		Timeout:       serverTimeout,
+		MaxRetries:    10,
+		lastDataSeen:  make(map[uint16]time.Time),
+		serverTimeout: serverTimeout,
+	}
+}
+
+// Starts a Connection for the first packet, as ListenForNewConnections would, except that the
+// first packet is never lost.
+func (c *SimulatedClient) Start(fs *FileSystem, maxRetries int, first Packet) {
+	options := ConnectionOptions{
+		Host:        "127.0.0.1",
+		Timeout:     c.serverTimeout,
+		MaxRetries:  maxRetries,
+		DallyPeriod: c.Timeout * time.Duration(c.MaxRetries+1), // Long enough to outlast all of our retries.
+	}
+	conn, err := MakeConnection(&options, c.conn.LocalAddr().(*net.UDPAddr), MarshalPacket(first), fs)
+	if err != nil {
+		panic(err)
+	}
+	c.sessionAddr = conn.Conn.LocalAddr().(*net.UDPAddr)
+	go conn.Listen()
+}
+
+func (c *SimulatedClient) Send(packet Packet) {
+	copies := 1
+	if c.rng.Float64() < c.DropRate {
+		copies = 0
+	} else if c.rng.Float64() < c.DuplicateRate {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i++ {
+		_, err := c.conn.WriteToUDP(MarshalPacket(packet), c.sessionAddr)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Receives a packet that survived the network, or nil on timeout.
+func (c *SimulatedClient) Receive(timeout time.Duration) Packet {
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, MaxPacketSize)
+
+	for {
+		c.conn.SetReadDeadline(deadline)
+		bytesRead, _, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+
+		packet, err := UnmarshalPacket(buf[:bytesRead])
+		if err != nil {
+			panic(err)
+		}
+
+		// Check for the Sorcerer's Apprentice before simulating loss, since what we're
+		// checking is the server's behavior.
+		if data, isData := packet.(*DataPacket); isData {
+			now := time.Now()
+			last, seen := c.lastDataSeen[data.Block]
+			if seen && now.Sub(last) < c.serverTimeout/2 && c.ApprenticeBlock == 0 {
+				c.ApprenticeBlock = data.Block
+			}
+			c.lastDataSeen[data.Block] = now
+		}
+
+		if c.rng.Float64() < c.DropRate {
+			continue
+		}
+
+		return packet
+	}
+}
+
+// Sends a packet until a reply satisfying accept is received.
+func (c *SimulatedClient) Exchange(request Packet, accept func(Packet) bool) (Packet, error) {
+	for retries := 0; retries <= c.MaxRetries; retries++ {
+		c.Send(request)
+
+		deadline := time.Now().Add(c.Timeout)
+		for time.Now().Before(deadline) {
+			reply := c.Receive(deadline.Sub(time.Now()))
+			if reply == nil {
+				break
+			}
+			if errPacket, isError := reply.(*ErrorPacket); isError {
+				return nil, fmt.Errorf("Server sent error %d: %s", errPacket.ErrorCode, errPacket.ErrMsg)
+			}
+			if accept(reply) {
+				return reply, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Gave up sending %v", request)
+}
+
+func (c *SimulatedClient) Upload(fs *FileSystem, maxRetries int, filename string, content []byte) error {
+	c.Start(fs, maxRetries, &WriteRequestPacket{RequestPacket{filename, "octet", nil}})
+
+	block := uint16(0)
+	isAck := func(expected uint16) func(Packet) bool {
+		return func(p Packet) bool {
+			ack, ok := p.(*AckPacket)
+			return ok && ack.Block == expected
+		}
+	}
+
+	// The WRQ itself can't be lost, so wait for ACK 0 without sending anything.
+	reply := c.Receive(c.Timeout * time.Duration(c.MaxRetries))
+	if reply == nil || !isAck(0)(reply) {
+		return fmt.Errorf("Expected ACK 0, got %v", reply)
+	}
+
+	for {
+		end := int(block)*FullDataPayloadLength + FullDataPayloadLength
+		if end > len(content) {
+			end = len(content)
+		}
+		chunk := content[int(block)*FullDataPayloadLength : end]
+		block++
+
+		_, err := c.Exchange(&DataPacket{block, chunk}, isAck(block))
+		if err != nil {
+			return err
+		}
+
+		if len(chunk) < FullDataPayloadLength {
+			return nil
+		}
+	}
+}
+
+func (c *SimulatedClient) Download(fs *FileSystem, maxRetries int, filename string) ([]byte, error) {
+	c.Start(fs, maxRetries, &ReadRequestPacket{RequestPacket{filename, "octet", nil}})
+
+	var content bytes.Buffer
+	isData := func(expected uint16) func(Packet) bool {
+		return func(p Packet) bool {
+			data, ok := p.(*DataPacket)
+			return ok && data.Block == expected
+		}
+	}
+
+	// The RRQ itself can't be lost, so wait for DATA 1 without sending anything.
+	var reply Packet
+	for reply == nil || !isData(1)(reply) {
+		reply = c.Receive(c.Timeout * time.Duration(c.MaxRetries))
+		if reply == nil {
+			return nil, fmt.Errorf("Never received DATA 1")
+		}
+	}
+
+	for {
+		data := reply.(*DataPacket)
+		content.Write(data.Data)
+
+		if len(data.Data) < FullDataPayloadLength {
+			// Best-effort final ACK. If it's lost, the server re-sends the last DATA and
+			// eventually gives up, but we already have the file.
+			c.Send(&AckPacket{data.Block})
+			return content.Bytes(), nil
+		}
+
+		var err error
+		reply, err = c.Exchange(&AckPacket{data.Block}, isData(data.Block+1))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func MakeTestContent(seed int64, length int) []byte {
+	content := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func StoreTestFile(fs *FileSystem, filename string, content []byte) {
+	file, err := fs.CreateFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	for start := 0; ; start += FullDataPayloadLength {
+		end := start + FullDataPayloadLength
+		if end > len(content) {
+			end = len(content)
+		}
+		file.Append(content[start:end])
+		if end-start < FullDataPayloadLength {
+			break
+		}
+	}
+	fs.Commit(file)
+}
+
+// A duplicated ACK must not be answered with a duplicate DATA packet, but the DATA it
+// acknowledged must still be re-sent when the server's timeout expires.
+func TestDuplicateAckDoesNotResendData(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "foo", MakeTestContent(1, 3*FullDataPayloadLength-1))
+
+	client := MakeSimulatedClient(1, timeout)
+	client.Start(fs, 3, &ReadRequestPacket{RequestPacket{"foo", "octet", nil}})
+
+	reply := client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*DataPacket).Block != 1, "Expected DATA 1")
+
+	client.Send(&AckPacket{1})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*DataPacket).Block != 2, "Expected DATA 2")
+
+	// The ACK for DATA 1 is duplicated by the network. No reply should come until the server times out.
+	sent := time.Now()
+	client.Send(&AckPacket{1})
+	reply = client.Receive(2 * timeout)
+	ErrorIf(t, reply == nil || reply.(*DataPacket).Block != 2, "Expected DATA 2 to be re-sent")
+	ErrorIf(t, time.Now().Sub(sent) < timeout/2, "DATA 2 was re-sent in reply to a duplicate ACK")
+
+	client.Send(&AckPacket{2})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*DataPacket).Block != 3, "Expected DATA 3")
+	client.Send(&AckPacket{3})
+}
+
+// A duplicated DATA packet must not erase the server's pending ACK, which is re-sent on timeout.
+func TestDuplicateDataKeepsPendingAck(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	fs := MakeFileSystem()
+
+	client := MakeSimulatedClient(1, timeout)
+	client.Start(fs, 3, &WriteRequestPacket{RequestPacket{"foo", "octet", nil}})
+
+	reply := client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 0, "Expected ACK 0")
+
+	client.Send(&DataPacket{1, MakePaddedBytes("hi")})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 1, "Expected ACK 1")
+
+	client.Send(&DataPacket{1, MakePaddedBytes("hi")})
+	reply = client.Receive(2 * timeout)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 1, "Expected ACK 1 to be re-sent")
+
+	client.Send(&DataPacket{2, []byte("there")})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 2, "Expected ACK 2")
+}
+
+// If the final ACK of an upload is lost, the server dallies long enough to ACK the re-sent final DATA.
+func TestDallyAfterFinalAck(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	fs := MakeFileSystem()
+
+	client := MakeSimulatedClient(1, timeout)
+	client.Start(fs, 3, &WriteRequestPacket{RequestPacket{"foo", "octet", nil}})
+
+	reply := client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 0, "Expected ACK 0")
+
+	client.Send(&DataPacket{1, []byte("hi")})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 1, "Expected ACK 1")
+
+	// Pretend ACK 1 never arrived. The server must not re-send it on its own...
+	reply = client.Receive(2 * timeout)
+	ErrorIf(t, reply != nil, "Final ACK should not be re-sent on timeout")
+
+	// ...but must answer the re-sent final DATA.
+	client.Send(&DataPacket{1, []byte("hi")})
+	reply = client.Receive(timeout / 2)
+	ErrorIf(t, reply == nil || reply.(*AckPacket).Block != 1, "Expected ACK 1 to be re-sent while dallying")
+}
+
+// Runs many transfers over a lossy network, checking that every one completes intact and that the
+// server never falls into the Sorcerer's Apprentice syndrome.
+func TestLossyTransfers(t *testing.T) {
+	const timeout = 20 * time.Millisecond
+	const maxRetries = 10
+	fs := MakeFileSystem()
+
+	for seed := int64(0); seed < 8; seed++ {
+		content := MakeTestContent(seed, 20*FullDataPayloadLength+int(seed))
+		filename := fmt.Sprintf("file%d", seed)
+
+		uploader := MakeSimulatedClient(seed, timeout)
+		uploader.DropRate = 0.1
+		uploader.DuplicateRate = 0.2
+		err := uploader.Upload(fs, maxRetries, filename, content)
+		if err != nil {
+			t.Fatalf("Upload %d failed: %v", seed, err)
+		}
+
+		downloader := MakeSimulatedClient(seed, timeout)
+		downloader.DropRate = 0.1
+		downloader.DuplicateRate = 0.2
+		downloaded, err := downloader.Download(fs, maxRetries, filename)
+		if err != nil {
+			t.Fatalf("Download %d failed: %v", seed, err)
+		}
+
+		ErrorIf(t, !bytes.Equal(content, downloaded), fmt.Sprintf("Download %d doesn't match upload", seed))
+		ErrorIf(t, downloader.ApprenticeBlock != 0, fmt.Sprintf("Download %d re-sent DATA %d early", seed, downloader.ApprenticeBlock))
+	}
+}
@@ -0,0 +1,226 @@
+// Snapshot.go saves the committed files to a single archive on disk, and restores them on startup,
+// so the store can stay in memory and still survive a restart.
+// The archive is a tar file with an entry for each file. Each entry carries the file's SHA-256, which
+// is checked on restore, its other checksums, the file's uploader and its version; its modification time is when the file
+// was committed. Older versions of a file come before the latest one. Whiteouts (see overlay.go) follow the files
+// as character devices 0:0, the way overlayfs writes them.
+// Snapshots are written to a temporary file first and renamed into place, so a crash while
+// writing one leaves the last snapshot intact.
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SnapshotChecksumKey = "TFTPD.sha256"
+	SnapshotUploaderKey = "TFTPD.uploader"
+	SnapshotVersionKey  = "TFTPD.version"
+
+	SnapshotChecksumPrefix = "TFTPD.checksum." // Followed by the algorithm, for checksums other than SHA-256.
+)
+
+// Writes every committed file to the archive.
+func WriteSnapshot(fs *FileSystem, w io.Writer) error {
+	// Committed files don't change, so they can be read once we unlock. Their names can, so we note them now.
+	var files, filenames, whiteouts = []*File{}, []string{}, []string{}
+	fs.Lock()
+	for filename, file := range fs.Files {
+		for _, version := range append(fs.History[filename], file) {
+			files = append(files, version)
+			filenames = append(filenames, filename)
+		}
+	}
+	for filename := range fs.Whiteouts {
+		whiteouts = append(whiteouts, filename)
+	}
+	fs.Unlock()
+
+	archive := tar.NewWriter(w)
+	for i, file := range files {
+		filename := filenames[i]
+		hash := sha256.New()
+		for page := file.Pages.Front(); page != nil; page = page.Next() {
+			hash.Write(page.Value.([]byte))
+		}
+
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filename,
+			Size:     int64(file.Size),
+			Mode:     0644,
+			ModTime:  file.Created,
+			Format:   tar.FormatPAX,
+			PAXRecords: map[string]string{
+				SnapshotChecksumKey: hex.EncodeToString(hash.Sum(nil)),
+				SnapshotVersionKey:  strconv.Itoa(file.Version),
+			},
+		}
+		if file.Uploader != "" {
+			header.PAXRecords[SnapshotUploaderKey] = file.Uploader
+		}
+		for algorithm, sum := range file.Checksums {
+			if algorithm != "sha256" {
+				header.PAXRecords[SnapshotChecksumPrefix+algorithm] = sum
+			}
+		}
+
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		for page := file.Pages.Front(); page != nil; page = page.Next() {
+			if _, err := archive.Write(page.Value.([]byte)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, filename := range whiteouts {
+		header := &tar.Header{Typeflag: tar.TypeChar, Name: filename, Format: tar.FormatPAX}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// Commits every file in the archive. Nothing is committed if any file is corrupt.
+// Whiteouts are only restored if the FileSystem is part of an overlay.
+func ReadSnapshot(fs *FileSystem, r io.Reader) error {
+	var restored []*File
+	var whiteouts []string
+	archive := tar.NewReader(r)
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		// Filenames are whatever clients asked for, so paths that would be unsafe to extract are expected.
+		if err != nil && err != tar.ErrInsecurePath {
+			return err
+		}
+		if header.Typeflag == tar.TypeChar {
+			whiteouts = append(whiteouts, header.Name)
+			continue
+		}
+
+		file := &File{
+			Filename: header.Name,
+			Created:  header.ModTime,
+			Uploader: header.PAXRecords[SnapshotUploaderKey],
+			Store:    fs.PageStore,
+		}
+		file.Version, _ = strconv.Atoi(header.PAXRecords[SnapshotVersionKey]) // Zero if missing, so it'll be numbered.
+		hash := sha256.New()
+
+		// Files are split into pages the same way uploads are, including an empty last page.
+		for {
+			page := make([]byte, FullDataPayloadLength)
+			bytesRead, err := io.ReadFull(archive, page)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			file.Append(page[:bytesRead])
+			hash.Write(page[:bytesRead])
+			if bytesRead < FullDataPayloadLength {
+				break
+			}
+		}
+
+		if hex.EncodeToString(hash.Sum(nil)) != header.PAXRecords[SnapshotChecksumKey] {
+			return fmt.Errorf("Checksum mismatch for %s", header.Name)
+		}
+
+		file.Checksums = map[string]string{"sha256": header.PAXRecords[SnapshotChecksumKey]}
+		for key, sum := range header.PAXRecords {
+			if algorithm, isChecksum := strings.CutPrefix(key, SnapshotChecksumPrefix); isChecksum {
+				file.Checksums[algorithm] = sum
+			}
+		}
+		restored = append(restored, file)
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+	seen := make(map[string]bool)
+	for _, file := range restored {
+		// The snapshot replaces files we already have, but its own versions of a file build up its history.
+		if existing := fs.Files[file.Filename]; existing != nil && !seen[file.Filename] {
+			fs.remove(existing)
+		}
+		seen[file.Filename] = true
+		fs.store(file)
+	}
+	for _, filename := range whiteouts {
+		fs.whiteOut(filename)
+	}
+	Log.Println("Restored", len(restored), "files")
+	return nil
+}
+
+// Saves a snapshot to the path, replacing the last one.
+func SaveSnapshot(fs *FileSystem, path string) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Fails harmlessly once the snapshot has been renamed into place.
+
+	err = WriteSnapshot(fs, temp)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// Restores the snapshot at the path. It's fine if there isn't one yet.
+func LoadSnapshot(fs *FileSystem, path string) error {
+	archive, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return ReadSnapshot(fs, archive)
+}
+
+// Saves a snapshot every interval, if the files have changed since the last one.
+func SnapshotPeriodically(fs *FileSystem, path string, interval time.Duration) {
+	saved := fs.GetGeneration()
+
+	for range time.Tick(interval) {
+		generation := fs.GetGeneration()
+		if generation == saved {
+			continue
+		}
+
+		if err := SaveSnapshot(fs, path); err != nil {
+			Log.Println("Failed to save snapshot due to", err)
+			continue
+		}
+		saved = generation
+		Log.Println("Saved snapshot to", path)
+	}
+}
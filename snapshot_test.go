@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func MakeTestStore() *FileSystem {
+	fs := MakeFileSystem()
+	StoreTestFile(fs, "empty", []byte{})
+	StoreTestFile(fs, "boot/pxelinux.0", MakeTestContent(1, FullDataPayloadLength))
+	StoreTestFile(fs, "/abs/../image", MakeTestContent(2, 3*FullDataPayloadLength+7))
+
+	ws := MakeWriteSession(fs)
+	ws.RemoteAddr = ParseRemoteAddr("192.168.1.5:2000")
+	Upload(ws, "uploaded", bytes.NewReader([]byte("from a client")), -1)
+	return fs
+}
+
+// A restored store has the same files, split into the same pages, with the same metadata.
+func TestSnapshotRoundTrip(t *testing.T) {
+	fs := MakeTestStore()
+	path := filepath.Join(t.TempDir(), "snapshot.tar")
+
+	ErrorIf(t, LoadSnapshot(MakeFileSystem(), path) != nil, "A missing snapshot should restore nothing")
+	if err := SaveSnapshot(fs, path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := MakeFileSystem()
+	if err := LoadSnapshot(restored, path); err != nil {
+		t.Fatal(err)
+	}
+
+	ErrorIf(t, len(restored.Files) != len(fs.Files), "Restored the wrong number of files")
+	for filename, file := range fs.Files {
+		restoredFile := restored.Files[filename]
+		if restoredFile == nil {
+			t.Error("Missing", filename)
+			continue
+		}
+		ErrorIf(t, restoredFile.Size != file.Size || restoredFile.GetNumBlocks() != file.GetNumBlocks(), "Wrong size for "+filename)
+		ErrorIf(t, restoredFile.Uploader != file.Uploader, "Wrong uploader for "+filename)
+		ErrorIf(t, !restoredFile.Created.Equal(file.Created), "Wrong creation time for "+filename)
+
+		original, _ := fs.GetReader(filename)
+		reader, _ := restored.GetReader(filename)
+		for {
+			ErrorIf(t, !bytes.Equal(reader.ReadBlock(), original.ReadBlock()), "Wrong content for "+filename)
+			if original.AtEnd() {
+				break
+			}
+			original.AdvanceBlock()
+			reader.AdvanceBlock()
+		}
+	}
+	ErrorIf(t, restored.Files["uploaded"].Uploader != "192.168.1.5:2000", "Uploader not restored")
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.tar")
+	if err := SaveSnapshot(MakeTestStore(), path); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, _ := os.ReadFile(path)
+	corrupt := bytes.Replace(archive, []byte("from a client"), []byte("from a hacker"), 1)
+	ErrorIf(t, bytes.Equal(corrupt, archive), "Test should have corrupted the archive")
+
+	fs := MakeFileSystem()
+	ErrorIf(t, ReadSnapshot(fs, bytes.NewReader(corrupt)) == nil, "Corrupt snapshot should fail to restore")
+	ErrorIf(t, ReadSnapshot(fs, bytes.NewReader(archive[:len(archive)/2])) == nil, "Truncated snapshot should fail to restore")
+	ErrorIf(t, len(fs.Files) != 0, "Nothing should be restored from a bad snapshot")
+}
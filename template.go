@@ -0,0 +1,150 @@
+// Template.go renders files from text/templates for each client, for PXE and iPXE boot configs
+// (pxelinux.cfg/default, boot.ipxe and so on) that differ from host to host.
+// Templates are loaded from a directory, and a template is served under its path relative to that directory.
+// Templates can use:
+//   {{.ClientIP}}    The address of the client.
+//   {{.Filename}}    The requested filename.
+//   {{.ServerAddr}}  Our address.
+//   {{.Host.key}}    Values for the client from the inventory. Rendering fails if the key is missing.
+//
+// The inventory is a JSON file of values for each host, keyed by IP address.
+// Values under "default" apply to every host, unless the host has its own:
+//   {"default": {"role": "compute"}, "192.168.1.5": {"hostname": "node5"}}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+)
+
+// Rendered files are cached, until there are this many of them, when the cache starts over.
+const MaxRenderedTemplates = 4096
+
+// What templates are rendered with.
+type TemplateData struct {
+	ClientIP   string
+	Filename   string
+	ServerAddr string
+	Host       map[string]string
+}
+
+// A ContentProvider rendering files from templates.
+type TemplateProvider struct {
+	Templates  map[string]*template.Template // Keyed by filename.
+	Inventory  map[string]map[string]string  // Keyed by IP address, or "default".
+	ServerAddr string
+	Rendered   map[string][]byte // Cache keyed by filename and client IP.
+	sync.Mutex                   // Guards Rendered.
+}
+
+// Loads every file under the directory as a template, and the inventory if there is one.
+func LoadTemplateProvider(dir string, inventoryPath string, serverAddr string) (*TemplateProvider, error) {
+	provider := &TemplateProvider{
+		Templates:  make(map[string]*template.Template),
+		Inventory:  make(map[string]map[string]string),
+		ServerAddr: serverAddr,
+		Rendered:   make(map[string][]byte),
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(relative)
+
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := template.New(filename).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return err
+		}
+		provider.Templates[filename] = tmpl
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if inventoryPath != "" {
+		data, err := os.ReadFile(inventoryPath)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &provider.Inventory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return provider, nil
+}
+
+func (p *TemplateProvider) Provide(filename string, client *net.UDPAddr) (io.Reader, error) {
+	tmpl := p.Templates[filename]
+	if tmpl == nil {
+		return nil, nil
+	}
+
+	var clientIP string
+	if client != nil {
+		clientIP = client.IP.String()
+	}
+
+	key := filename + "\x00" + clientIP
+
+	p.Lock()
+	rendered, cached := p.Rendered[key]
+	p.Unlock()
+	if cached {
+		return bytes.NewReader(rendered), nil
+	}
+
+	data := TemplateData{
+		ClientIP:   clientIP,
+		Filename:   filename,
+		ServerAddr: p.ServerAddr,
+		Host:       p.HostValues(clientIP),
+	}
+
+	var output bytes.Buffer
+	err := tmpl.Execute(&output, data)
+	if err != nil {
+		Log.Println("Failed to render", filename, "for", clientIP, "due to", err)
+		return nil, &ErrorPacket{ERR_UNDEFINED, "Failed to render " + filename}
+	}
+
+	p.Lock()
+	if len(p.Rendered) >= MaxRenderedTemplates {
+		p.Rendered = make(map[string][]byte)
+	}
+	p.Rendered[key] = output.Bytes()
+	p.Unlock()
+
+	return bytes.NewReader(output.Bytes()), nil
+}
+
+// Returns the inventory values for the host, on top of the defaults.
+func (p *TemplateProvider) HostValues(clientIP string) map[string]string {
+	values := make(map[string]string)
+	for key, value := range p.Inventory["default"] {
+		values[key] = value
+	}
+	for key, value := range p.Inventory[clientIP] {
+		values[key] = value
+	}
+	return values
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func MakeTestTemplateProvider(t *testing.T) *TemplateProvider {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "templates", "pxelinux.cfg"), 0755)
+	os.WriteFile(filepath.Join(dir, "templates", "pxelinux.cfg", "default"),
+		[]byte("DEFAULT {{.Host.role}}\nAPPEND ip={{.ClientIP}} server={{.ServerAddr}} file={{.Filename}}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "templates", "boot.ipxe"),
+		[]byte("#!ipxe\nset hostname {{.Host.hostname}}\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "inventory.json"),
+		[]byte(`{"default": {"role": "compute"}, "10.0.0.5": {"hostname": "node5", "role": "storage"}}`), 0644)
+
+	provider, err := LoadTemplateProvider(filepath.Join(dir, "templates"), filepath.Join(dir, "inventory.json"), "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func Render(t *testing.T, provider *TemplateProvider, filename string, ip string) (string, error) {
+	stream, err := provider.Provide(filename, &net.UDPAddr{IP: net.ParseIP(ip), Port: 1000})
+	if err != nil || stream == nil {
+		return "", err
+	}
+	rendered, _ := io.ReadAll(stream)
+	return string(rendered), nil
+}
+
+func TestTemplateRendering(t *testing.T) {
+	provider := MakeTestTemplateProvider(t)
+
+	rendered, err := Render(t, provider, "pxelinux.cfg/default", "10.0.0.5")
+	ErrorIf(t, err != nil, "Rendering failed")
+	ErrorIf(t, rendered != "DEFAULT storage\nAPPEND ip=10.0.0.5 server=10.0.0.1 file=pxelinux.cfg/default\n", "Rendered wrong: "+rendered)
+
+	// Hosts missing from the inventory get the defaults.
+	rendered, err = Render(t, provider, "pxelinux.cfg/default", "10.0.0.6")
+	ErrorIf(t, err != nil, "Rendering failed")
+	ErrorIf(t, rendered != "DEFAULT compute\nAPPEND ip=10.0.0.6 server=10.0.0.1 file=pxelinux.cfg/default\n", "Rendered wrong: "+rendered)
+
+	// Files without templates aren't provided.
+	stream, err := provider.Provide("other", nil)
+	ErrorIf(t, stream != nil || err != nil, "Should not provide files without templates")
+}
+
+// A template using an inventory value the host doesn't have fails with an ERROR for the client.
+func TestTemplateRenderingFailure(t *testing.T) {
+	provider := MakeTestTemplateProvider(t)
+
+	_, err := Render(t, provider, "boot.ipxe", "10.0.0.6")
+	errPacket, isErrPacket := err.(*ErrorPacket)
+	ErrorIf(t, !isErrPacket || errPacket.ErrorCode != ERR_UNDEFINED, "Expected an ErrorPacket")
+
+	h := TestHarness{t}
+	rs := MakeReadSession(MakeFileSystem())
+	rs.RemoteAddr = &net.UDPAddr{IP: net.ParseIP("10.0.0.6"), Port: 1000}
+	rs.Providers = MakeContentProviders()
+	rs.Providers.AddPrefix("", provider)
+	h.Verify(rs, &ReadRequestPacket{RequestPacket{"boot.ipxe", "octet", nil}}, &ErrorPacket{ERR_UNDEFINED, "Failed to render boot.ipxe"})
+	h.VerifyDead(rs)
+}
+
+func TestTemplateCache(t *testing.T) {
+	provider := MakeTestTemplateProvider(t)
+
+	first, _ := Render(t, provider, "boot.ipxe", "10.0.0.5")
+	ErrorIf(t, len(provider.Rendered) != 1, "Rendered file should be cached")
+
+	// Changing the inventory doesn't affect cached output.
+	provider.Inventory["10.0.0.5"]["hostname"] = "renamed"
+	second, _ := Render(t, provider, "boot.ipxe", "10.0.0.5")
+	ErrorIf(t, !bytes.Equal([]byte(first), []byte(second)), "Cached output should be served")
+}
@@ -1,5 +1,6 @@
 // TFTP Daemon
 // Implements RFC 1350, in octet mode only, over UDP and with files stored in memory only.
+// Reads may also use the multicast option of RFC 2090.
 // There are three layers:
 // * Connection layer - listens for connection requests and communicates with callers.
 // * Session layer    - receives request packets and returns reply packets.
@@ -10,7 +11,11 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -19,15 +24,207 @@ var Log = log.New(os.Stdout, "", log.Ltime|log.Lshortfile)
 func main() {
 	var options ConnectionOptions
 
-	options.IntroductionPort = *flag.Int("port", 69, "port to listen on.")
-	options.Host = *flag.String("host", "127.0.0.1", "host address to listen on.")
-	options.MaxRetries = *flag.Int("maxretries", 3, "maximum amount of times to retry a send before terminating the connection.")
-	timeoutSeconds := *flag.Int("timeout", 3, "receive timeout in seconds before resending the last packet.")
-	options.Timeout = time.Second * time.Duration(timeoutSeconds)
+	flag.IntVar(&options.IntroductionPort, "port", 69, "port to listen on.")
+	flag.StringVar(&options.Host, "host", "127.0.0.1", "host address to listen on.")
+	flag.IntVar(&options.MaxRetries, "maxretries", 3, "maximum amount of times to retry a send before terminating the connection.")
+	timeoutSeconds := flag.Int("timeout", 3, "receive timeout in seconds before resending the last packet.")
+	dallySeconds := flag.Int("dally", 3, "seconds to linger after the final ACK of an upload, in case it was lost.")
+	multicast := flag.String("multicast", "", "multicast address and first port for the multicast option (e.g. 239.255.42.1:1758). Disabled if empty.")
+	remap := flag.String("remap", "", "file of rules for remapping requested filenames (see remap.go.)")
+	templates := flag.String("templates", "", "directory of templates to render files from for each client (see template.go.)")
+	inventory := flag.String("inventory", "", "JSON file of values for each host, for templates.")
+	origin := flag.String("origin", "", "base URL of an HTTP server to fetch files we don't have from.")
+	originCacheMB := flag.Int("origincache", 256, "megabytes of files fetched from the origin to cache.")
+	originMaxAge := flag.Int("originmaxage", 60, "seconds to serve a cached file from the origin before revalidating it.")
+	layers := flag.String("layers", "", "read-only directories to serve files from under the uploaded files, top first (e.g. /srv/site,/srv/base.) Deleting a file hides it in them (see overlay.go.)")
+	follow := flag.Bool("follow", false, "let clients read files while they're uploaded (see follow.go.)")
+	listings := flag.Bool("listings", false, "serve a listing of each directory as <dir>/.listing (see directory.go.)")
+	archives := flag.String("archives", "", "tar, tar.gz and zip archives to serve files from, under prefixes (e.g. boot/=boot.tar.gz,ipxe/=ipxe.zip.)")
+	httpAddr := flag.String("http", "", "address to serve files over HTTP on (e.g. :8080). Disabled if empty.")
+	httpPut := flag.Bool("httpput", false, "allow uploads over HTTP with PUT.")
+	adminAddr := flag.String("admin", "", "address to serve the admin API on (see admin.go.) Disabled if empty.")
+	adminTokenFile := flag.String("admintokenfile", "", "file holding the bearer token the admin API requires. Read from $"+AdminTokenVariable+" if empty; one of them is required with -admin.")
+	quotaMB := flag.Int("quota", 0, "megabytes all the files together may take up. Unlimited if 0.")
+	maxFileMB := flag.Int("maxfile", 0, "megabytes any one file may take up. Unlimited if 0.")
+	clientQuotaMB := flag.Int("clientquota", 0, "megabytes the files uploaded by each client may take up. Unlimited if 0.")
+	evict := flag.Bool("evict", false, "evict the least recently used files to make room for uploads, rather than refusing them, when -quota is reached.")
+	ttl := flag.Duration("ttl", 0, "how long to keep files for (e.g. 72h). Kept until deleted if 0.")
+	prefixTTLs := flag.String("prefixttl", "", "how long to keep files under prefixes for, overriding -ttl (e.g. crash/=24h,configs/=720h.)")
+	janitorSeconds := flag.Int("janitor", 60, "seconds between looking for expired files.")
+	versioned := flag.Bool("versions", false, "keep older versions of files that are uploaded again, readable as name@version or name@time (see version.go.)")
+	maxVersions := flag.Int("maxversions", 0, "how many versions of a file to keep, including the latest. Unlimited if 0.")
+	maxVersionAge := flag.Duration("maxversionage", 0, "how long to keep older versions of files for. Unlimited if 0.")
+	checksums := flag.String("checksums", "", "checksums to compute for uploads as well as SHA-256 (md5, crc32), e.g. md5,crc32.")
+	manifest := flag.String("manifest", "", "file of SHA-256s uploads must match, in the format sha256sum writes (see checksum.go.)")
+	hooks := flag.String("hooks", "", "commands and webhook URLs to tell about uploads (e.g. /usr/local/bin/diff-config,https://alerts.example.com/tftp; see hook.go.)")
+	hookTimeout := flag.Duration("hooktimeout", 30*time.Second, "how long each attempt to run a hook may take.")
+	hookRetries := flag.Int("hookretries", 3, "how many times to retry a hook that failed.")
+	hookQueue := flag.Int("hookqueue", 1000, "how many events may wait for the hooks before more are dropped. The git store keeps the latest for each file waiting in memory instead.")
+	gitDir := flag.String("git", "", "git repository to commit uploads to, and read files and their revisions from (see gitstore.go.)")
+	validators := flag.String("validators", "", "file of validators uploads must pass before they're committed (see validate.go.)")
+	snapshot := flag.String("snapshot", "", "file to save the files to, and restore them from on startup (see snapshot.go.) Disabled if empty.")
+	snapshotSeconds := flag.Int("snapshotinterval", 60, "seconds between snapshots, if files have changed. Snapshots are also saved on shutdown.")
 	flag.Parse()
+	options.Timeout = time.Second * time.Duration(*timeoutSeconds)
+	options.DallyPeriod = time.Second * time.Duration(*dallySeconds)
 
-	Log.Printf("Listening on host %s, port %d\n", options.Host, options.IntroductionPort)
+	if *multicast != "" {
+		addr, err := net.ResolveUDPAddr("udp", *multicast)
+		if err != nil || !addr.IP.IsMulticast() {
+			Log.Fatalln("Bad multicast address:", *multicast)
+		}
+		options.Multicast = MakeMulticastGroups(addr.IP, addr.Port)
+	}
+
+	if *remap != "" {
+		remapper, err := LoadRemapRules(*remap)
+		if err != nil {
+			Log.Fatalln("Couldn't load remap rules:", err)
+		}
+		options.Remap = remapper
+	}
 
 	fs := MakeFileSystem()
+
+	if *templates != "" {
+		provider, err := LoadTemplateProvider(*templates, *inventory, options.Host)
+		if err != nil {
+			Log.Fatalln("Couldn't load templates:", err)
+		}
+		// Templates take precedence over stored files.
+		options.Providers = MakeContentProviders()
+		options.Providers.AddPrefix("", provider)
+	}
+
+	// The layers come before the origin, so files deleted from them aren't fetched from it instead.
+	if *layers != "" {
+		overlay, err := LoadOverlay(fs, *layers)
+		if err != nil {
+			Log.Fatalln("Couldn't load layers:", err)
+		}
+		if options.Providers == nil {
+			options.Providers = MakeContentProviders()
+		}
+		options.Providers.AddFallback(overlay)
+	}
+
+	if *origin != "" {
+		if options.Providers == nil {
+			options.Providers = MakeContentProviders()
+		}
+		options.Providers.AddFallback(MakeOriginProvider(*origin, *originCacheMB<<20, time.Second*time.Duration(*originMaxAge)))
+	}
+
+	if *archives != "" {
+		if options.Providers == nil {
+			options.Providers = MakeContentProviders()
+		}
+		if err := MountArchives(options.Providers, *archives); err != nil {
+			Log.Fatalln("Couldn't mount archives:", err)
+		}
+	}
+
+	Log.Printf("Listening on host %s, port %d\n", options.Host, options.IntroductionPort)
+
+	fs.Quota = Quota{MaxBytes: *quotaMB << 20, MaxFileBytes: *maxFileMB << 20, MaxClientBytes: *clientQuotaMB << 20}
+	fs.EvictLRU = *evict
+	fs.Listings = *listings
+	fs.LiveReads = *follow
+
+	if *hooks != "" {
+		fs.Hooks = MakeHooks(*hookQueue, ParseHooks(*hooks)...)
+		fs.Hooks.Timeout = *hookTimeout
+		fs.Hooks.Retries = *hookRetries
+		go fs.Hooks.Run()
+	}
+	if *gitDir != "" {
+		store, err := OpenGitStore(*gitDir)
+		if err != nil {
+			Log.Fatalln("Couldn't open git repository:", err)
+		}
+		// The git store has a queue of its own, so slow hooks don't hold it up, and it never misses an upload.
+		fs.Backups = MakeHooks(*hookQueue, store)
+		fs.Backups.Timeout = *hookTimeout
+		fs.Backups.Retries = *hookRetries
+		fs.Backups.Lossless = true
+		go fs.Backups.Run()
+		if options.Providers == nil {
+			options.Providers = MakeContentProviders()
+		}
+		options.Providers.AddFallback(store)
+	}
+
+	fs.Versioning = Versioning{Enabled: *versioned, MaxVersions: *maxVersions, MaxAge: *maxVersionAge}
+
+	algorithms, err := ParseChecksumAlgorithms(*checksums)
+	if err != nil {
+		Log.Fatalln(err)
+	}
+	fs.Integrity.Algorithms = algorithms
+	if *manifest != "" {
+		fs.Integrity.Expected, err = LoadManifest(*manifest)
+		if err != nil {
+			Log.Fatalln("Couldn't load manifest:", err)
+		}
+	}
+
+	if *validators != "" {
+		fs.Validators, err = LoadValidators(*validators)
+		if err != nil {
+			Log.Fatalln("Couldn't load validators:", err)
+		}
+	}
+
+	prefixed, err := ParsePrefixedTTLs(*prefixTTLs)
+	if err != nil {
+		Log.Fatalln("Bad prefix TTLs:", err)
+	}
+	fs.Expiry = Expiry{Default: *ttl, Prefixed: prefixed}
+	if *ttl > 0 || len(prefixed) > 0 || *maxVersionAge > 0 {
+		go RunJanitor(fs, time.Second*time.Duration(*janitorSeconds))
+	}
+
+	if *snapshot != "" {
+		if err := LoadSnapshot(fs, *snapshot); err != nil {
+			Log.Fatalln("Couldn't restore snapshot:", err)
+		}
+		if *snapshotSeconds > 0 {
+			go SnapshotPeriodically(fs, *snapshot, time.Second*time.Duration(*snapshotSeconds))
+		}
+
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-shutdown
+			if err := SaveSnapshot(fs, *snapshot); err != nil {
+				Log.Fatalln("Failed to save snapshot due to", err)
+			}
+			Log.Println("Saved snapshot to", *snapshot)
+			os.Exit(0)
+		}()
+	}
+
+	if *httpAddr != "" {
+		Log.Printf("Serving HTTP on %s\n", *httpAddr)
+		go func() {
+			Log.Fatalln(http.ListenAndServe(*httpAddr, MakeGateway(&options, fs, *httpPut)))
+		}()
+	}
+
+	if *adminAddr != "" {
+		adminToken, err := LoadAdminToken(*adminTokenFile)
+		if err != nil {
+			Log.Fatalln("Failed to read the admin token:", err)
+		}
+		if adminToken == "" {
+			Log.Fatalln("The admin API needs a token, from -admintokenfile or $" + AdminTokenVariable)
+		}
+		options.Transfers = MakeTransfers()
+		Log.Printf("Serving the admin API on %s\n", *adminAddr)
+		go func() {
+			Log.Fatalln(http.ListenAndServe(*adminAddr, MakeAdmin(fs, options.Transfers, adminToken)))
+		}()
+	}
+
 	ListenForNewConnections(&options, fs)
 }
@@ -0,0 +1,239 @@
+// Validate.go checks uploads once their last block has arrived, before they're committed, so files that
+// aren't valid are refused rather than served. Validators run in order, and the first to refuse a file decides
+// the ERROR the client gets.
+//
+// A validators file has one validator per line. Blank lines and lines starting with # are ignored.
+// Globs are matched against the whole filename, or only its last element if they have no slash,
+// so *.img matches images/x86/boot.img.
+//
+//   size    <glob> <bytes>           Refuses matching files larger than bytes.
+//   magic   <glob> <hex>[,<hex>...]  Refuses matching files that don't start with one of the byte sequences.
+//   names   <glob>[,<glob>...]       Refuses files that don't match any of the globs.
+//   command <glob> <path>            Runs a scanner or signature check with the file on its standard input and
+//                                    "--" and its name as its arguments, refusing matching files if it exits
+//                                    with an error.
+//                                    The first line it prints is the error message.
+//
+// Any line may end with a message in double quotes, which the client gets instead of the usual one:
+//   magic *.img 27051956 "Not a U-Boot image"
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a command may take to check a file. The client is waiting for its last ACK meanwhile.
+const CommandValidatorTimeout = 10 * time.Second
+
+type Validator interface {
+	// Returns the ERROR to refuse the file with, or nil to accept it.
+	Validate(file *File) *ErrorPacket
+}
+
+// Lets ordinary functions be used as Validators.
+type ValidatorFunc func(file *File) *ErrorPacket
+
+func (f ValidatorFunc) Validate(file *File) *ErrorPacket {
+	return f(file)
+}
+
+type Validators []Validator
+
+// Runs each validator in turn, stopping at the first to refuse the file.
+func (v Validators) Validate(file *File) *ErrorPacket {
+	for _, validator := range v {
+		if err := validator.Validate(file); err != nil {
+			Log.Println("Refused", file.Filename, "due to", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the filename matches the glob. Globs without a slash are matched against the last element.
+func MatchesGlob(glob string, filename string) bool {
+	if !strings.Contains(glob, "/") {
+		filename = path.Base(filename)
+	}
+	matches, _ := path.Match(glob, filename)
+	return matches
+}
+
+// Returns the custom message if there is one, otherwise the usual one.
+func Refusal(code uint16, message string, custom string) *ErrorPacket {
+	if custom != "" {
+		message = custom
+	}
+	return &ErrorPacket{code, message}
+}
+
+type SizeValidator struct {
+	Glob     string
+	MaxBytes int
+	Message  string
+}
+
+func (v *SizeValidator) Validate(file *File) *ErrorPacket {
+	if MatchesGlob(v.Glob, file.Filename) && file.Size > v.MaxBytes {
+		return Refusal(ERR_DISK_FULL, "File too large", v.Message)
+	}
+	return nil
+}
+
+type MagicValidator struct {
+	Glob    string
+	Magic   [][]byte // The file must start with one of these.
+	Message string
+}
+
+func (v *MagicValidator) Validate(file *File) *ErrorPacket {
+	if !MatchesGlob(v.Glob, file.Filename) {
+		return nil
+	}
+
+	// Only the last page is shorter than a block, so the first holds any magic number there is.
+	var start []byte
+	if first := file.Pages.Front(); first != nil {
+		start = first.Value.([]byte)
+	}
+	for _, magic := range v.Magic {
+		if bytes.HasPrefix(start, magic) {
+			return nil
+		}
+	}
+	return Refusal(ERR_ACCESS_VIOLATION, "Wrong file type", v.Message)
+}
+
+type FilenameValidator struct {
+	Globs   []string // The filename must match one of these.
+	Message string
+}
+
+func (v *FilenameValidator) Validate(file *File) *ErrorPacket {
+	for _, glob := range v.Globs {
+		if MatchesGlob(glob, file.Filename) {
+			return nil
+		}
+	}
+	return Refusal(ERR_ACCESS_VIOLATION, "Filename not allowed", v.Message)
+}
+
+type CommandValidator struct {
+	Glob    string
+	Path    string
+	Message string
+}
+
+func (v *CommandValidator) Validate(file *File) *ErrorPacket {
+	if !MatchesGlob(v.Glob, file.Filename) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CommandValidatorTimeout)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, v.Path, "--", file.Filename)
+	command.Stdin = FileContent(file)
+	output, err := command.Output()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		message, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+		if message == "" {
+			message = "Refused by " + path.Base(v.Path)
+		}
+		return Refusal(ERR_ACCESS_VIOLATION, message, v.Message)
+	}
+	if err != nil {
+		Log.Println("Failed to run", v.Path, "on", file.Filename, "due to", err)
+		return &ErrorPacket{ERR_UNDEFINED, "Failed to validate file"}
+	}
+	return nil
+}
+
+func LoadValidators(path string) (Validators, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseValidators(file)
+}
+
+func ParseValidators(r io.Reader) (Validators, error) {
+	var validators Validators
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text, message, _ := strings.Cut(scanner.Text(), "\"")
+		fields := strings.Fields(text)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		validator, err := ParseValidator(fields, strings.TrimSuffix(strings.TrimSpace(message), "\""))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		validators = append(validators, validator)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return validators, nil
+}
+
+func ParseValidator(fields []string, message string) (Validator, error) {
+	if fields[0] == "names" {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Expected names and globs")
+		}
+		return &FilenameValidator{Globs: strings.Split(fields[1], ","), Message: message}, nil
+	}
+
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("Expected a validator, a glob and an argument")
+	}
+	glob, argument := fields[1], fields[2]
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("Bad glob %q", glob)
+	}
+
+	switch fields[0] {
+	case "size":
+		maxBytes, err := strconv.Atoi(argument)
+		if err != nil || maxBytes < 0 {
+			return nil, fmt.Errorf("Bad size %q", argument)
+		}
+		return &SizeValidator{Glob: glob, MaxBytes: maxBytes, Message: message}, nil
+	case "magic":
+		validator := &MagicValidator{Glob: glob, Message: message}
+		for _, magicHex := range strings.Split(argument, ",") {
+			magic, err := hex.DecodeString(magicHex)
+			if err != nil || len(magic) == 0 || len(magic) > FullDataPayloadLength {
+				return nil, fmt.Errorf("Bad magic number %q", magicHex)
+			}
+			validator.Magic = append(validator.Magic, magic)
+		}
+		return validator, nil
+	case "command":
+		return &CommandValidator{Glob: glob, Path: argument, Message: message}, nil
+	default:
+		return nil, fmt.Errorf("Unknown validator %q", fields[0])
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	h := TestHarness{t}
+	dir := t.TempDir()
+	scanner := filepath.Join(dir, "scan.sh")
+	os.WriteFile(scanner, []byte("#!/bin/sh\nif grep -q EICAR; then echo \"Infected: $2\"; exit 1; fi\n"), 0755)
+
+	validators, err := ParseValidators(strings.NewReader(`
+# Only configs and images.
+names  configs/*,*.img
+size   configs/* 100 "Configs are small"
+magic  *.img 27051956,d00dfeed
+command *.img ` + scanner + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := MakeFileSystem()
+	fs.Validators = validators
+
+	Upload := func(filename string, content []byte, expected Packet) {
+		ws := MakeWriteSession(fs)
+		h.Verify(ws, &WriteRequestPacket{RequestPacket{filename, "octet", nil}}, &AckPacket{0})
+		h.Verify(ws, &DataPacket{1, content}, expected)
+		ws.Close()
+	}
+
+	Upload("configs/core1", []byte("hostname core1"), &AckPacket{1})
+	Upload("images/x86/boot.img", []byte("\x27\x05\x19\x56 kernel"), &AckPacket{1})
+	Upload("images/board.img", []byte("\xd0\x0d\xfe\xed tree"), &AckPacket{1})
+
+	Upload("notes.txt", []byte("hello"), &ErrorPacket{ERR_ACCESS_VIOLATION, "Filename not allowed"})
+	Upload("configs/huge", MakeTestContent(1, 200), &ErrorPacket{ERR_DISK_FULL, "Configs are small"})
+	Upload("images/bad.img", []byte("MZ not an image"), &ErrorPacket{ERR_ACCESS_VIOLATION, "Wrong file type"})
+	Upload("images/virus.img", []byte("\x27\x05\x19\x56 EICAR"), &ErrorPacket{ERR_ACCESS_VIOLATION, "Infected: images/virus.img"})
+	Upload("-virus.img", []byte("\x27\x05\x19\x56 EICAR"), &ErrorPacket{ERR_ACCESS_VIOLATION, "Infected: -virus.img"})
+
+	ErrorIf(t, len(fs.Files) != 3, "Only valid uploads should be committed")
+	ErrorIf(t, fs.Usage.Bytes != fs.Usage.StoredBytes, "Refused uploads should give back their space")
+
+	// Scanners that can't run refuse everything they would check.
+	fs.Validators = Validators{&CommandValidator{Glob: "*", Path: filepath.Join(dir, "missing")}}
+	Upload("anything", []byte("x"), &ErrorPacket{ERR_UNDEFINED, "Failed to validate file"})
+
+	// Validators can be any function.
+	fs.Validators = Validators{ValidatorFunc(func(file *File) *ErrorPacket {
+		if file.Size == 0 {
+			return &ErrorPacket{ERR_ACCESS_VIOLATION, "Empty"}
+		}
+		return nil
+	})}
+	Upload("empty", []byte{}, &ErrorPacket{ERR_ACCESS_VIOLATION, "Empty"})
+
+	for _, bad := range []string{"size *", "size * big", "magic * zz", "names", "scan * x", "size [ 10"} {
+		_, err := ParseValidators(strings.NewReader(bad))
+		ErrorIf(t, err == nil, "Expected "+bad+" to fail to parse")
+	}
+}
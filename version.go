@@ -0,0 +1,96 @@
+// Version.go keeps older versions of files, so a device re-uploading its config doesn't lose the old one.
+// With versioning enabled, committing a file that already exists makes it the latest version, and reads
+// get the latest version unless they ask for another with a suffix on the filename:
+//   name@3                 Version 3 of the file.
+//   name@2026-10-01T12:00  The version that was the latest at that time (UTC). Seconds and a time zone
+//                          may be given too, as in RFC 3339, or just the date.
+// A file really named like that is always read first.
+// Older versions are pruned once there are more than MaxVersions of them, or once they're older than MaxAge,
+// but the latest version is never pruned.
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Versioning struct {
+	Enabled     bool
+	MaxVersions int           // How many versions to keep, including the latest. Unlimited if 0.
+	MaxAge      time.Duration // How long older versions are kept, from when they were committed. Unlimited if 0.
+}
+
+var VersionTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// Finds the file, or the version of a file, the filename asks for. Must be called with the lock held.
+func (f *FileSystem) lookup(filename string) *File {
+	if file := f.Files[filename]; file != nil {
+		return file
+	}
+
+	at := strings.LastIndex(filename, "@")
+	if at < 0 || f.Files[filename[:at]] == nil {
+		return nil
+	}
+	latest, spec := f.Files[filename[:at]], filename[at+1:]
+	versions := append(append([]*File{}, f.History[latest.Filename]...), latest)
+
+	if version, err := strconv.Atoi(spec); err == nil {
+		for _, file := range versions {
+			if file.Version == version {
+				return file
+			}
+		}
+		return nil
+	}
+
+	for _, layout := range VersionTimeLayouts {
+		when, err := time.Parse(layout, spec)
+		if err != nil {
+			continue
+		}
+
+		var found *File
+		for _, file := range versions {
+			if !file.Created.After(when) {
+				found = file
+			}
+		}
+		return found
+	}
+
+	return nil
+}
+
+// Prunes the older versions of the file that are past the retention limits. Must be called with the lock held.
+func (f *FileSystem) prune(filename string, now time.Time) {
+	history := f.History[filename]
+	pruned := 0
+
+	for pruned < len(history) {
+		oldest := history[pruned]
+		tooMany := f.Versioning.MaxVersions > 0 && len(history)-pruned+1 > f.Versioning.MaxVersions
+		tooOld := f.Versioning.MaxAge > 0 && now.Sub(oldest.Created) > f.Versioning.MaxAge
+		if !tooMany && !tooOld {
+			break
+		}
+
+		f.release(oldest)
+		oldest.Store.Release(oldest)
+		pruned++
+		Log.Println("Pruned version", oldest.Version, "of", filename)
+	}
+
+	if pruned > 0 {
+		f.Generation++
+	}
+
+	switch {
+	case pruned == len(history):
+		delete(f.History, filename)
+	case pruned > 0:
+		// Copied, so the pruned versions can be garbage collected.
+		f.History[filename] = append([]*File{}, history[pruned:]...)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func ReadTestFile(fs *FileSystem, filename string) string {
+	reader, err := fs.GetReader(filename)
+	if err != nil {
+		return ""
+	}
+
+	var content []byte
+	for {
+		content = append(content, reader.ReadBlock()...)
+		if reader.AtEnd() {
+			return string(content)
+		}
+		reader.AdvanceBlock()
+	}
+}
+
+func MakeVersionedStore() *FileSystem {
+	fs := MakeFileSystem()
+	fs.Versioning.Enabled = true
+	for _, content := range []string{"one", "two", "three"} {
+		StoreTestFile(fs, "cfg", []byte(content))
+	}
+	return fs
+}
+
+func TestVersionLookup(t *testing.T) {
+	fs := MakeVersionedStore()
+	versions := append(fs.History["cfg"], fs.Files["cfg"])
+	versions[0].Created = time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+	versions[1].Created = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	versions[2].Created = time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC)
+
+	ErrorIf(t, ReadTestFile(fs, "cfg") != "three", "Reads should get the latest version")
+	ErrorIf(t, ReadTestFile(fs, "cfg@1") != "one", "Version 1 wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@3") != "three", "Version 3 wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@4") != "", "Missing versions should not be found")
+	ErrorIf(t, ReadTestFile(fs, "cfg@2026-10-01T12:00") != "two", "Version by time wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@2026-10-01T11:59:59") != "one", "Version by time with seconds wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@2026-10-02T01:00:00+02:00") != "two", "Version by time with a zone wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@2026-10-05") != "three", "Version by date wrong")
+	ErrorIf(t, ReadTestFile(fs, "cfg@2026-09-30") != "", "Nothing was committed before the first version")
+	ErrorIf(t, ReadTestFile(fs, "cfg@latest") != "", "Unknown suffixes should not be found")
+
+	StoreTestFile(fs, "cfg@1", []byte("literal"))
+	ErrorIf(t, ReadTestFile(fs, "cfg@1") != "literal", "Files really named with a suffix should be read first")
+
+	// Without versioning, files can't be uploaded again.
+	fs = MakeFileSystem()
+	StoreTestFile(fs, "x", []byte("x"))
+	_, err := fs.CreateFile("x")
+	ErrorIf(t, err == nil || err.ErrorCode != ERR_FILE_ALREADY_EXISTS, "Existing files should not be writable without versioning")
+}
+
+func TestVersionRetention(t *testing.T) {
+	fs := MakeFileSystem()
+	fs.Versioning = Versioning{Enabled: true, MaxVersions: 2}
+	for _, content := range []string{"one", "two", "three"} {
+		StoreTestFile(fs, "cfg", []byte(content))
+	}
+	ErrorIf(t, len(fs.History["cfg"]) != 1 || fs.History["cfg"][0].Version != 2, "Only the newest versions should be kept")
+	ErrorIf(t, fs.Usage.Bytes != len("two")+len("three"), "Pruned versions should give back their space")
+
+	fs.Versioning = Versioning{Enabled: true, MaxAge: time.Hour}
+	fs.Expire(time.Now().Add(2 * time.Hour))
+	ErrorIf(t, fs.History["cfg"] != nil, "Old versions should be pruned")
+	ErrorIf(t, ReadTestFile(fs, "cfg") != "three", "The latest version should never be pruned")
+}
+
+// Versions follow their file when it's renamed, deleted or snapshotted.
+func TestVersionHistoryMoves(t *testing.T) {
+	fs := MakeVersionedStore()
+
+	var archive bytes.Buffer
+	if err := WriteSnapshot(fs, &archive); err != nil {
+		t.Fatal(err)
+	}
+	restored := MakeFileSystem()
+	if err := ReadSnapshot(restored, &archive); err != nil {
+		t.Fatal(err)
+	}
+	ErrorIf(t, ReadTestFile(restored, "cfg@2") != "two" || ReadTestFile(restored, "cfg") != "three", "Snapshot should keep the versions")
+	ErrorIf(t, restored.Files["cfg"].Version != 3, "Snapshot should keep the version numbers")
+
+	fs.Rename("cfg", "old")
+	ErrorIf(t, ReadTestFile(fs, "old@1") != "one" || ReadTestFile(fs, "old") != "three", "Rename should move the versions")
+	ErrorIf(t, fs.History["cfg"] != nil, "Nothing should be left under the old name")
+
+	fs.Delete("old")
+	ErrorIf(t, len(fs.History) != 0 || fs.Usage.Bytes != 0, "Delete should remove every version")
+}